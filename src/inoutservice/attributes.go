@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"regexp"
+	"strings"
+)
+
+// Person fields that are filled in from LDAP attributes
+const (
+	fieldName       = "Name"
+	fieldDepartment = "Department"
+	fieldTelephone  = "Telephone"
+	fieldMobile     = "Mobile"
+	fieldOffice     = "Office"
+	fieldTitle      = "Title"
+	fieldBoard      = "Board"
+)
+
+// The attributes used for each field when the
+// [LdapAttributes] section doesn't list any
+var defaultAttributes = map[string][]string{
+	fieldName:       {"cn"},
+	fieldDepartment: {"department"},
+	fieldTelephone:  {"telephoneNumber"},
+	fieldMobile:     {"mobile"},
+	fieldOffice:     {"physicalDeliveryOfficeName"},
+	fieldTitle:      {"title"},
+}
+
+// A transform applied to the values of an attribute
+type attributeTransform func(values []string) []string
+
+// One source for a field: an attribute and the transforms
+// to apply to its values, parsed from a line like
+//
+//	ipPhone|trim|regex:([0-9]+)$
+type attributeSource struct {
+	attribute  string
+	transforms []attributeTransform
+}
+
+// The sources for a field, in order. The first source that
+// gives a non-empty value wins, so later ones are fallbacks.
+type fieldMapping []attributeSource
+
+// Parse the [LdapAttributes] section of the config file
+func parseAttributeMappings(cfg *Config) (map[string]fieldMapping, error) {
+	lines := map[string][]string{
+		fieldName:       cfg.LdapAttributes.Name,
+		fieldDepartment: cfg.LdapAttributes.Department,
+		fieldTelephone:  cfg.LdapAttributes.Telephone,
+		fieldMobile:     cfg.LdapAttributes.Mobile,
+		fieldOffice:     cfg.LdapAttributes.Office,
+		fieldTitle:      cfg.LdapAttributes.Title,
+		fieldBoard:      cfg.LdapAttributes.Board,
+	}
+
+	mappings := make(map[string]fieldMapping)
+	for field, specs := range lines {
+		if len(specs) == 0 {
+			specs = defaultAttributes[field]
+		}
+		for _, spec := range specs {
+			source, err := parseAttributeSource(spec)
+			if err != nil {
+				return nil, fmt.Errorf("bad LdapAttributes %s: %s", field, err)
+			}
+			mappings[field] = append(mappings[field], source)
+		}
+	}
+	return mappings, nil
+}
+
+// parse an attribute and its transforms. A regex takes the
+// rest of the line as its pattern, |s and all, so it has to
+// be the last transform.
+func parseAttributeSource(spec string) (attributeSource, error) {
+	attribute, rest, more := strings.Cut(spec, "|")
+	source := attributeSource{attribute: strings.TrimSpace(attribute)}
+	if source.attribute == "" {
+		return source, fmt.Errorf("%q has no attribute", spec)
+	}
+
+	for more {
+		var part string
+		part, rest, more = strings.Cut(rest, "|")
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), ":")
+		switch strings.ToLower(name) {
+		case "trim":
+			source.transforms = append(source.transforms, eachValue(strings.TrimSpace))
+		case "lower":
+			source.transforms = append(source.transforms, eachValue(strings.ToLower))
+		case "upper":
+			source.transforms = append(source.transforms, eachValue(strings.ToUpper))
+		case "first":
+			source.transforms = append(source.transforms, func(values []string) []string {
+				if len(values) > 1 {
+					return values[:1]
+				}
+				return values
+			})
+		case "join":
+			source.transforms = append(source.transforms, func(values []string) []string {
+				return []string{strings.Join(values, ", ")}
+			})
+		case "regex":
+			if more {
+				arg, more = strings.TrimSpace(arg+"|"+rest), false
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return source, err
+			}
+			source.transforms = append(source.transforms, regexTransform(re))
+		default:
+			return source, fmt.Errorf("unknown transform %q", part)
+		}
+	}
+	return source, nil
+}
+
+// apply a function to every value
+func eachValue(fn func(string) string) attributeTransform {
+	return func(values []string) []string {
+		transformed := make([]string, len(values))
+		for i, value := range values {
+			transformed[i] = fn(value)
+		}
+		return transformed
+	}
+}
+
+// Keep only the values that match a regular expression. If it
+// has a group, the first group is kept instead of the whole match.
+func regexTransform(re *regexp.Regexp) attributeTransform {
+	return func(values []string) []string {
+		matched := make([]string, 0, len(values))
+		for _, value := range values {
+			match := re.FindStringSubmatch(value)
+			if match == nil {
+				continue
+			}
+			if len(match) > 1 {
+				matched = append(matched, match[1])
+			} else {
+				matched = append(matched, match[0])
+			}
+		}
+		return matched
+	}
+}
+
+// Get the value of a field from an LDAP entry
+func (m fieldMapping) value(entry *ldap.Entry) string {
+	for _, source := range m {
+		values := entry.GetAttributeValues(source.attribute)
+		for _, transform := range source.transforms {
+			values = transform(values)
+		}
+		for _, value := range values {
+			if value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// all of the attributes the mappings read
+func mappedAttributes(mappings map[string]fieldMapping) []string {
+	attributes := make([]string, 0)
+	for _, mapping := range mappings {
+		for _, source := range mapping {
+			attributes = append(attributes, source.attribute)
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"gopkg.in/ldap.v2"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseAttributeSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		values    []string
+		attribute string
+		want      []string
+		wantErr   bool
+	}{
+		{"attribute only", "telephoneNumber", []string{" 555 1234 "}, "telephoneNumber", []string{" 555 1234 "}, false},
+		{"trim", "telephoneNumber|trim", []string{" 555 1234 "}, "telephoneNumber", []string{"555 1234"}, false},
+		{"lower", "mail | lower", []string{"Bob@Example.COM"}, "mail", []string{"bob@example.com"}, false},
+		{"upper", "c|UPPER", []string{"ca"}, "c", []string{"CA"}, false},
+		{"first", "ou|first", []string{"Sales", "Support"}, "ou", []string{"Sales"}, false},
+		{"join", "ou|join", []string{"Sales", "Support"}, "ou", []string{"Sales, Support"}, false},
+		{"transforms in order", "ou|first|upper", []string{"Sales", "Support"}, "ou", []string{"SALES"}, false},
+		{"regex", "ipPhone|regex:([0-9]{4})$", []string{"555-1234", "none"}, "ipPhone", []string{"1234"}, false},
+		{"regex after transforms", "ipPhone|trim|regex:([0-9]+)$", []string{"x 1234 "}, "ipPhone", []string{"1234"}, false},
+		{"regex with |", "ipPhone|regex:^(ext|x)\\s*([0-9]+)$", []string{"ext 12", "x9", "12"}, "ipPhone", []string{"ext", "x"}, false},
+		{"regex with a group of alternatives", "title|regex:(Manager|Director)", []string{"Sales Director"}, "title", []string{"Director"}, false},
+		{"regex keeps | in a transform name", "title|regex:upper|lower", []string{"upper"}, "title", []string{"upper"}, false},
+		{"no attribute", "|trim", nil, "", nil, true},
+		{"empty", "", nil, "", nil, true},
+		{"unknown transform", "cn|reverse", nil, "", nil, true},
+		{"bad regex", "cn|regex:(", nil, "", nil, true},
+		{"bad regex with |", "cn|regex:(a|b", nil, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := parseAttributeSource(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAttributeSource(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if source.attribute != tt.attribute {
+				t.Errorf("parseAttributeSource(%q) attribute = %q, want %q", tt.spec, source.attribute, tt.attribute)
+			}
+			values := tt.values
+			for _, transform := range source.transforms {
+				values = transform(values)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("parseAttributeSource(%q) transforms %q to %q, want %q", tt.spec, tt.values, values, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegexTransform(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		values  []string
+		want    []string
+	}{
+		{"whole match", `[0-9]+`, []string{"room 101", "annex"}, []string{"101"}},
+		{"first group", `^([A-Z]+)-([0-9]+)$`, []string{"HQ-12"}, []string{"HQ"}},
+		{"optional group that doesn't take part", `^([0-9]+)?x`, []string{"x"}, []string{""}},
+		{"no match", `^[0-9]+$`, []string{"n/a"}, []string{}},
+		{"no values", `.*`, nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := regexTransform(regexp.MustCompile(tt.pattern))(tt.values)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("regex %q on %q = %q, want %q", tt.pattern, tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldMappingValue(t *testing.T) {
+	mapping := fieldMapping{}
+	for _, spec := range []string{"ipPhone|regex:([0-9]{4})$", "telephoneNumber|trim"} {
+		source, err := parseAttributeSource(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapping = append(mapping, source)
+	}
+	tests := []struct {
+		name       string
+		attributes map[string][]string
+		want       string
+	}{
+		{"first source", map[string][]string{"ipPhone": {"555-1234"}, "telephoneNumber": {"555 9999"}}, "1234"},
+		{"falls back when nothing matches", map[string][]string{"ipPhone": {"none"}, "telephoneNumber": {" 555 9999 "}}, "555 9999"},
+		{"falls back when missing", map[string][]string{"telephoneNumber": {"555 9999"}}, "555 9999"},
+		{"skips empty values", map[string][]string{"telephoneNumber": {"  ", "555 9999"}}, "555 9999"},
+		{"nothing", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapping.value(ldap.NewEntry("cn=bob", tt.attributes)); got != tt.want {
+				t.Errorf("value = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
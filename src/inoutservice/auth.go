@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/leonelquinteros/gorand"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/ldap.v2"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	_ "strings"
 	"time"
@@ -28,14 +30,47 @@ type Error struct {
 }
 
 // A set of options necessary to find
-// and login to a LDAP server
+// and login to the LDAP directories
 type AuthorizationOptions struct {
-	realm          string
-	ldapServer     string
-	port           int
-	username       string
-	password       string
-	ldapSearchBase string
+	directories []*directory
+	roleGroups  map[string][]string
+	// where Person fields come from
+	attributes map[string]fieldMapping
+}
+
+// Set up the LDAP directories and the options shared by
+// them from the config file. The [Auth] section is the main
+// directory, and each [Directory "name"] section adds another.
+func newAuthorizationOptions(cfg *Config) (AuthorizationOptions, error) {
+	var options AuthorizationOptions
+	var err error
+
+	if len(cfg.Auth.LdapServer) > 0 {
+		d, err := newDirectory("default", &cfg.Auth, false)
+		if err != nil {
+			return options, fmt.Errorf("[Auth]: %s", err)
+		}
+		options.directories = append(options.directories, d)
+	}
+	names := make([]string, 0, len(cfg.Directory))
+	for name := range cfg.Directory {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d, err := newDirectory(name, cfg.Directory[name], true)
+		if err != nil {
+			return options, fmt.Errorf("[Directory \"%s\"]: %s", name, err)
+		}
+		options.directories = append(options.directories, d)
+	}
+	if len(options.directories) == 0 {
+		return options, errors.New("no LDAP directories are configured")
+	}
+
+	options.roleGroups = roleGroupsFromConfig(cfg)
+	options.attributes, err = parseAttributeMappings(cfg)
+	return options, err
 }
 
 type Credentials struct {
@@ -51,44 +86,69 @@ func init() {
 	http.Handle("/logout", logoutHandler)
 }
 
-// LdapAuthFunc authenticates a user against an LDAP server
-// The Request parameter is probably not necessary.
-func LdapAuthFunc(creds *Credentials) bool {
-	hostaddr := fmt.Sprintf("%s:%d", authOptions.ldapServer, authOptions.port) // move to config file
-	conn, err := ldap.Dial("tcp", hostaddr)
-	if err != nil {
-		log.Fatal(err)
+// LdapAuthFunc authenticates a user against an LDAP server.
+// It returns false for bad credentials, and an error if
+// the LDAP server could not be asked.
+func LdapAuthFunc(creds *Credentials) (bool, error) {
+	if len(creds.Password) == 0 {
+		return false, nil
 	}
 
-	defer conn.Close()
-
-	err = conn.StartTLS(&tls.Config{InsecureSkipVerify: true})
-	if err != nil {
-		log.Printf("Could not connect to LDAP: %s", err)
-		log.Fatal(err)
+	dirs, name := authOptions.directoriesFor(creds.Username)
+	if len(dirs) == 0 {
+		log.Infof("User %s is not in a known directory", creds.Username)
+		return false, nil
 	}
 
-	dn, err := SanitizeDN(creds.Username)
+	dn, err := SanitizeDN(name)
 	if err != nil {
 		log.Infof("User %s attempted authentication with an invalid username", creds.Username)
-		return false
+		return false, nil
 	}
 
-	if len(creds.Password) == 0 {
-		return false
+	d := dirs[0]
+	bindName := userBindName(d, dn)
+	if len(dirs) > 1 || d.searchBind {
+		// find the user's directory and DN with the service account first
+		var entry *ldap.Entry
+		d, entry, err = authOptions.findEntry(creds.Username)
+		if errors.Is(err, ErrLdapUnavailable) {
+			log.Errorf("Could not authenticate %s: %s", creds.Username, err)
+			return false, err
+		}
+		if err != nil || entry == nil {
+			log.Infof("User %s was not found in LDAP: %v", creds.Username, err)
+			return false, nil
+		}
+		if d.searchBind {
+			bindName = entry.DN
+		} else {
+			bindName = userBindName(d, dn)
+		}
 	}
 
-	if strings.LastIndexAny(dn, "@") < 0 { // not an email address
-		dn = authOptions.realm + "\\" + dn
+	var authenticated bool
+	err = d.pool.do(func(conn *ldap.Conn) error {
+		if err := conn.Bind(bindName, creds.Password); err != nil {
+			if isLdapUnavailable(err) {
+				return err
+			}
+			log.Printf("LDAP: %s", err.Error())
+			authenticated = false
+		} else {
+			authenticated = true
+		}
+		// put the connection back the way the pool expects it
+		return conn.Bind(d.pool.bindName, d.pool.password)
+	})
+	if err != nil {
+		log.Errorf("Could not authenticate %s: %s", creds.Username, err)
+		return false, err
 	}
-	err = conn.Bind(dn, creds.Password)
-	if err == nil {
+	if authenticated {
 		log.Debugf("User %s logged in", creds.Username)
-		return true
-	} else {
-		log.Printf("LDAP: %s", err.Error())
-		return false
 	}
+	return authenticated, nil
 }
 
 // Escape a string for use in a DN
@@ -130,98 +190,144 @@ func SanitizeDN(dn string) (string, error) {
 	return newdn, nil
 }
 
-// Find a person in LDAP
+// Find a person in LDAP, in whichever directory
+// they belong to
 func FindUser(username string) (*Person, error) {
-	var user *Person
 	if authOptions == nil {
 		log.Panicf("Auth options should not be nil")
 	}
-	hostaddr := fmt.Sprintf("%s:%d", authOptions.ldapServer, authOptions.port)
-	conn, err := ldap.Dial("tcp", hostaddr)
-	if err != nil {
-		log.Fatal(err)
-		return user, err
-	}
-
-	defer conn.Close()
+	return authOptions.findUser(username)
+}
 
-	err = conn.StartTLS(&tls.Config{InsecureSkipVerify: true})
-	if err != nil {
-		log.Fatal(err)
-		return user, err
+// Find a person in LDAP with a given set of options
+func (o *AuthorizationOptions) findUser(username string) (*Person, error) {
+	d, ldapPerson, err := o.findEntry(username)
+	if ldapPerson == nil || err != nil {
+		return nil, err
 	}
+	return o.personFromEntry(d, ldapPerson), nil
+}
 
-	err = conn.Bind(authOptions.realm+"\\"+authOptions.username, authOptions.password)
-	if err != nil {
-		log.Fatal(err)
-		return user, err
+// Build a person from their LDAP entry. The board is left
+// empty unless a Board attribute is configured, so that LDAP
+// doesn't move people from the boards they've been put on.
+func (o *AuthorizationOptions) personFromEntry(d *directory, ldapPerson *ldap.Entry) *Person {
+	person := &Person{
+		Username:   d.canonicalUsername(ldapPerson.GetAttributeValue(d.usernameAttribute)),
+		Name:       o.attributes[fieldName].value(ldapPerson),
+		Department: o.attributes[fieldDepartment].value(ldapPerson),
+		Telephone:  o.attributes[fieldTelephone].value(ldapPerson),
+		Mobile:     o.attributes[fieldMobile].value(ldapPerson),
+		Office:     o.attributes[fieldOffice].value(ldapPerson),
+		Title:      o.attributes[fieldTitle].value(ldapPerson),
+		IsDeleted:  isDisabled(d.disabledRules, ldapPerson),
+		Groups:     ldapPerson.GetAttributeValues("memberOf"),
 	}
+	if len(o.attributes[fieldBoard]) > 0 {
+		person.Board = boards.assign(o.attributes[fieldBoard].value(ldapPerson))
+	}
+	return person
+}
 
-	dn, err := SanitizeDN(username)
+// Find the LDAP entry for a username, searching each directory
+// it could belong to. Returns a nil entry if there is no such
+// user. A user found in more than one directory is an error.
+func (o *AuthorizationOptions) findEntry(username string) (*directory, *ldap.Entry, error) {
+	dirs, name := o.directoriesFor(username)
+	dn, err := SanitizeDN(name)
 	if err != nil {
-		return user, fmt.Errorf("bad username")
+		return nil, nil, fmt.Errorf("bad username")
 	}
 
-	var queryString string
-	if strings.LastIndexAny(dn, "@") > 0 {
-		queryString = fmt.Sprintf("(&(objectClass=organizationalPerson)(userPrincipalName=%s))", dn)
-	} else {
-		queryString = fmt.Sprintf("(&(objectClass=organizationalPerson)(sAMAccountName=%s))", dn)
+	var found *ldap.Entry
+	var foundIn *directory
+	var searchErr error
+	for _, d := range dirs {
+		entry, err := searchUser(d, dn, userAttributes(d, o.attributes))
+		if err != nil {
+			searchErr = err
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		if found != nil {
+			log.Errorf("%s was found in both the %s and %s directories", username, foundIn.name, d.name)
+			return nil, nil, fmt.Errorf("%s is ambiguous; use DOMAIN\\user or a UPN", username)
+		}
+		found, foundIn = entry, d
 	}
+	if found == nil && searchErr != nil {
+		// the user may be in a directory we couldn't search
+		return nil, nil, searchErr
+	}
+	return foundIn, found, nil
+}
 
+// Search a directory for a user, with a username already
+// escaped by SanitizeDN, fetching the given attributes.
+// Returns nil if there is no such user.
+func searchUser(d *directory, dn string, attributes []string) (*ldap.Entry, error) {
 	searchRequest := ldap.NewSearchRequest(
-		authOptions.ldapSearchBase,
+		d.ldapSearchBase,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		queryString,
-		[]string{"userPrincipalName", "cn", "title", "department", "telephoneNumber", "mobile", "physicalDeliveryOfficeName"},
+		userFilter(d, dn),
+		attributes,
 		nil,
 	)
-	res, err := conn.Search(searchRequest)
+	var res *ldap.SearchResult
+	err := d.pool.do(func(conn *ldap.Conn) error {
+		var err error
+		res, err = conn.Search(searchRequest)
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("LDAP search for %s in %s failed: %s", dn, d.name, err)
+		return nil, err
 	}
 
 	if len(res.Entries) == 0 {
-		return nil, err
+		return nil, nil
 	}
 
 	if len(res.Entries) > 1 {
-		log.Errorf("Got %i entries for %s from LDAP", len(res.Entries), dn)
+		log.Errorf("Got %d entries for %s from LDAP", len(res.Entries), dn)
 		return nil, errors.New("Got too many results for LDAP query")
 	}
 
-	ldapPerson := res.Entries[0]
-
-	//ldapPerson.Printf()
-
-	user = &Person{
-		Username:   ldapPerson.GetAttributeValue("userPrincipalName"),
-		Name:       ldapPerson.GetAttributeValue("cn"),
-		Department: ldapPerson.GetAttributeValue("department"),
-		Telephone:  ldapPerson.GetAttributeValue("telephoneNumber"),
-		Mobile:     ldapPerson.GetAttributeValue("mobile"),
-		Office:     ldapPerson.GetAttributeValue("physicalDeliveryOfficeName"),
-		Title:      ldapPerson.GetAttributeValue("title"),
-		IsDeleted:  strings.Contains(ldapPerson.DN, "OU=Previous Employees"),
-	}
-	return user, err
+	return res.Entries[0], nil
 }
 
 // Create a user for a given username. This user must exist
 // in LDAP
 func CreateUser(username string) (*Person, error) {
-	var err error
-	var user *Person = new(Person)
-	user, err = FindUser(username)
+	user, err := FindUser(username)
 	if err != nil {
 		return nil, err
 	}
+	if user == nil {
+		return nil, fmt.Errorf("%s was not found in LDAP", username)
+	}
+	return addLdapUser(user)
+}
 
-	if sqlUser, err := GetPerson(user.Username); sqlUser != nil {
-		return sqlUser, err
+// Add a person found in LDAP to the database, unless
+// they are already there. Someone who was removed from
+// the board is put back.
+func addLdapUser(user *Person) (*Person, error) {
+	if sqlUser, err := store.GetPerson(user.Username); sqlUser != nil {
+		if !sqlUser.IsDeleted || user.IsDeleted {
+			return sqlUser, err
+		}
+		// they were removed, but are back in LDAP
+		log.Infof("Restoring %s to the board", user.Username)
+		if err = store.RestorePerson(user.Username); err != nil {
+			return nil, err
+		}
+		return store.GetPerson(user.Username)
 	}
 
-	user, err = AddPerson(
+	return store.AddPerson(
 		user.Username,
 		user.Name,
 		user.Department,
@@ -229,65 +335,31 @@ func CreateUser(username string) (*Person, error) {
 		user.Mobile,
 		user.Office,
 		user.Title,
+		user.Board,
 	)
-	return user, err
-}
-
-// Update all the database users with attributes
-// from LDAP. Accordingly, this takes a set of
-// LDAP connection options as a parameter
-func UpdateLdap(options AuthorizationOptions) error {
-	authOptions = &options
-	// get users
-	people, err := GetUsers()
-	if err != nil {
-		log.Fatalf("Failed to get users from the database: %s", err.Error())
-		return err
-	}
-	// for each user, get the LDAP entry
-	for _, user := range people {
-		updated, err := FindUser(user.Username)
-		if err != nil {
-			log.Printf("Failed to get user %s from the LDAP Server: %s", user.Username, err.Error())
-			continue
-		}
-		if updated == nil || updated.IsDeleted {
-			log.Infof("Removing previous employee %s", user.Username)
-			RemovePerson(user)
-			continue
-		}
-		// and update the database
-		user.Name = updated.Name
-		user.Department = updated.Department
-		user.Office = updated.Office
-		user.Telephone = updated.Telephone
-		user.Mobile = updated.Mobile
-		user.Title = updated.Title
-		log.Debugf("updating %s with name = %s, department = %s, office = %s telephone = %s, mobile = %s, title = %s",
-			user.Username,
-			user.Name,
-			user.Department,
-			user.Office,
-			user.Telephone,
-			user.Mobile,
-			user.Title)
-		if SetPersonDetails(user) != nil {
-			log.Printf("Failed to update user %s: %s", user.Username, err)
-		}
-
-		fmt.Printf(". ")
-	}
-	fmt.Printf("\n")
-	return nil
 }
 
 // Handles cookie-based authentication. An incoming
 // request will have its session ID read from a cookie, and if
 // the session is not valid, returns a JSON-encoded response
-// redirecting to the Login api endpoint.
-func AuthorizationMiddleware(options AuthorizationOptions, next http.Handler) http.Handler {
-	authOptions = &options
+// redirecting to the Login api endpoint. Requests with an
+// "Authorization: Bearer" header are authenticated with an
+// API token instead, and carry the token's scopes.
+func AuthorizationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			if username, scopes, err := store.ValidateToken(hashToken(token)); err == nil {
+				ctx := newContextWithScopes(newContextWithUsername(r.Context(), username), scopes)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			} else {
+				log.Printf("rejected API token: %s", err)
+				tokenErr := &Error{Message: "invalid token", Path: "/api/tokens/"}
+				content, _ := json.Marshal(tokenErr)
+				http.Error(w, string(content), http.StatusUnauthorized)
+			}
+			return
+		}
+
 		var session string = ""
 		cookies := r.Cookies()
 		for _, cookie := range cookies {
@@ -298,8 +370,9 @@ func AuthorizationMiddleware(options AuthorizationOptions, next http.Handler) ht
 			}
 		}
 
-		if username, err := ValidateSession(session); err == nil {
-			next.ServeHTTP(w, r.WithContext(newContextWithUsername(r.Context(), username)))
+		if username, roles, err := store.ValidateSession(session); err == nil {
+			ctx := newContextWithRoles(newContextWithUsername(r.Context(), username), roles)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			log.Println("no session found")
 			sessionErr := &Error{Message: "unauthorized", Path: "/login"}
@@ -325,7 +398,7 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	if err := RemoveSession(cookie.Value); err != nil {
+	if err := store.RemoveSession(cookie.Value); err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 	}
 	cookie.Value = ""
@@ -352,22 +425,63 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if LdapAuthFunc(creds) {
-		var person *Person
+	ip := clientIP(r)
+	var attempt *pendingLogin
+	if loginLimiter != nil {
+		var wait time.Duration
+		if attempt, wait = loginLimiter.begin(creds.Username, ip); wait > 0 {
+			log.Infof("Throttled login for %s from %s", creds.Username, ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			throttleErr := Error{Message: "too many failed logins", Path: "/login"}
+			content, _ := json.Marshal(throttleErr)
+			http.Error(w, string(content), http.StatusTooManyRequests)
+			return
+		}
+	}
 
-		if person, err = GetPerson(creds.Username); err != nil {
-			// create user from ldap store
-			person, err = CreateUser(creds.Username)
-			if err != nil {
-				log.Fatalf("Failed to create user: %s", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
+	authenticated, err := LdapAuthFunc(creds)
+	if err != nil {
+		if attempt != nil {
+			loginLimiter.abandon(attempt)
+		}
+		ldapUnavailable(w)
+		return
+	}
+
+	if attempt != nil && authenticated {
+		loginLimiter.success(attempt)
+	}
+
+	if authenticated {
+		// look the user up for their groups, which may
+		// have changed since they last logged in
+		ldapUser, err := FindUser(creds.Username)
+		if errors.Is(err, ErrLdapUnavailable) {
+			ldapUnavailable(w)
+			return
+		}
+		if err == nil && ldapUser == nil {
+			err = fmt.Errorf("%s was not found in LDAP", creds.Username)
 		}
-		if err = CreateSession(session, person.ID); err != nil {
+		if err != nil {
+			log.Errorf("Failed to find user: %s", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		log.Printf("created session %s", session)
+		roles := rolesForGroups(authOptions.roleGroups, ldapUser.Groups)
+
+		// create user from ldap store if they're new
+		person, err := addLdapUser(ldapUser)
+		if err != nil {
+			log.Errorf("Failed to create user: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = store.CreateSession(session, person.ID, roles); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("created session %s with roles %v", session, roles)
 
 		cookie := &http.Cookie{
 			Name:     "session",
@@ -390,7 +504,17 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// respond to a request that needs LDAP when the
+// LDAP servers are down
+func ldapUnavailable(w http.ResponseWriter) {
+	unavailableErr := Error{Message: "the directory server is unavailable", Path: "/login"}
+	content, _ := json.Marshal(unavailableErr)
+	http.Error(w, string(content), http.StatusServiceUnavailable)
+}
+
 const requestUsernameKey = 0
+const requestScopesKey = 1
+const requestRolesKey = 2
 
 // get the username from a context object
 func usernameFromContext(ctx context.Context) string {
@@ -401,3 +525,55 @@ func usernameFromContext(ctx context.Context) string {
 func newContextWithUsername(ctx context.Context, username string) context.Context {
 	return context.WithValue(ctx, requestUsernameKey, username)
 }
+
+// get the user's roles from a context object
+func rolesFromContext(ctx context.Context) []string {
+	roles, _ := ctx.Value(requestRolesKey).([]string)
+	return roles
+}
+
+// return a new context object with the user's roles in it
+func newContextWithRoles(ctx context.Context, roles []string) context.Context {
+	return context.WithValue(ctx, requestRolesKey, roles)
+}
+
+// check whether the user has a role. Admins have every role.
+func hasRole(ctx context.Context, role string) bool {
+	for _, r := range rolesFromContext(ctx) {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// get the API token scopes from a context object. A request
+// authenticated with a session cookie has no scopes, and
+// this returns nil.
+func scopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(requestScopesKey).([]string)
+	return scopes
+}
+
+// return a new context object with API token scopes in it
+func newContextWithScopes(ctx context.Context, scopes []string) context.Context {
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return context.WithValue(ctx, requestScopesKey, scopes)
+}
+
+// check whether a request may do something. Session-based
+// requests may do anything; token-based requests need the scope.
+func hasScope(ctx context.Context, scope string) bool {
+	scopes := scopesFromContext(ctx)
+	if scopes == nil {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pages copied at a time by a backup, letting other
+// connections write in between
+const backupStepPages = 256
+
+// how backup files are named
+const (
+	backupPrefix     = "inoutboard-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102-150405"
+)
+
+// backups to keep when the config file doesn't say
+const defaultBackupsToKeep = 7
+
+// returned when the database can't be backed up this way
+var errBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for PostgreSQL")
+
+// Where backups go, and how often they're made. Set from
+// the config file.
+type backupSchedule struct {
+	dir      string
+	interval time.Duration
+	keep     int
+}
+
+var backups backupSchedule
+
+// Get the backup settings from the config file
+func backupScheduleFromConfig(cfg *Config) backupSchedule {
+	b := backupSchedule{
+		dir:      cfg.Backup.Directory,
+		interval: time.Duration(cfg.Backup.IntervalHours) * time.Hour,
+		keep:     cfg.Backup.Keep,
+	}
+	if b.keep <= 0 {
+		b.keep = defaultBackupsToKeep
+	}
+	return b
+}
+
+// A backup file in the backup directory
+type BackupFile struct {
+	Name string
+	Size int64
+	Time time.Time
+}
+
+// Make a consistent copy of the database at path while it's
+// in use, with the SQLite online backup API. The copy is
+// written alongside and renamed into place when it's complete.
+func (s *sqlStore) Backup(path string) error {
+	if s.dialect != dialectSqlite {
+		return errBackupUnsupported
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := s.backupTo(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *sqlStore) backupTo(path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			destSqlite, ok := destDriver.(*sqlite3.SQLiteConn)
+			srcSqlite, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errBackupUnsupported
+			}
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					break
+				}
+				// the database is busy, or there is more to copy
+				time.Sleep(10 * time.Millisecond)
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// Back up the database to the backup directory, with a
+// name that says when it was made, and delete the oldest
+// backups beyond the number to keep
+func makeBackup(b backupSchedule) (*BackupFile, error) {
+	if b.dir == "" {
+		return nil, errors.New("no backup Directory is set in the [Backup] section of the config file")
+	}
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	name := backupPrefix + now.UTC().Format(backupTimeFormat) + backupSuffix
+	if err := store.Backup(filepath.Join(b.dir, name)); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(b.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Backed up the database to %s", filepath.Join(b.dir, name))
+
+	existing, err := listBackups(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := b.keep; i < len(existing); i++ {
+		log.Infof("Deleting old backup %s", existing[i].Name)
+		if err = os.Remove(filepath.Join(b.dir, existing[i].Name)); err != nil {
+			log.Errorf("Could not delete old backup %s: %s", existing[i].Name, err)
+		}
+	}
+	return &BackupFile{Name: name, Size: info.Size(), Time: now}, nil
+}
+
+// List the backups in a directory, newest first
+func listBackups(dir string) ([]*BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return make([]*BackupFile, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*BackupFile, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		made, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &BackupFile{Name: name, Size: info.Size(), Time: made.Local()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.After(files[j].Time) })
+	return files, nil
+}
+
+// Make a backup every interval, until the program exits
+func scheduleBackups(b backupSchedule) {
+	log.Infof("Backing up the database to %s every %s, keeping %d", b.dir, b.interval, b.keep)
+	ticker := time.NewTicker(b.interval)
+	for range ticker.C {
+		if _, err := makeBackup(b); err != nil {
+			log.Errorf("Scheduled backup failed: %s", err)
+		}
+	}
+}
+
+// Check that a backup can be restored: that it is an intact
+// SQLite database, with a schema this program knows about.
+// Returns its schema version.
+func checkBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("%s is not a database: %w", path, err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("%s is damaged: %s", path, result)
+	}
+	var version sql.NullInt64
+	if err = db.QueryRow("SELECT max(version) FROM schema_version").Scan(&version); err != nil || !version.Valid {
+		return 0, fmt.Errorf("%s has no schema version", path)
+	}
+	migrations, err := loadMigrations(dialectSqlite)
+	if err != nil {
+		return 0, err
+	}
+	if latest := migrations[len(migrations)-1].Version; int(version.Int64) > latest {
+		return 0, fmt.Errorf("%s is at schema version %d, but this program only knows up to %d", path, version.Int64, latest)
+	}
+	return int(version.Int64), nil
+}
+
+// Replace the database with a backup, keeping the old
+// database alongside. The service must not be running. This
+// is the --restore command.
+func restoreBackup(dbPath string, backupPath string) error {
+	version, err := checkBackup(backupPath)
+	if err != nil {
+		return err
+	}
+
+	// copy the backup next to the database first, so the
+	// swap itself is only renames
+	tmp := dbPath + ".restore"
+	os.Remove(tmp)
+	source, err := sql.Open("sqlite3", "file:"+backupPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	err = (&sqlStore{db: source, dialect: dialectSqlite}).backupTo(tmp)
+	source.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if _, err = os.Stat(dbPath); err == nil {
+		old := dbPath + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if err = os.Rename(dbPath, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		// the old database's write-ahead log goes with it
+		if _, err = os.Stat(dbPath + "-wal"); err == nil {
+			if err = os.Rename(dbPath+"-wal", old+"-wal"); err != nil {
+				return err
+			}
+		}
+		os.Remove(dbPath + "-shm")
+		fmt.Printf("The old database was kept as %s\n", old)
+	}
+	if err = os.Rename(tmp, dbPath); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s, at schema version %d\n", backupPath, version)
+	return nil
+}
+
+// List the backups, make one, or download one:
+//
+//	GET  /api/admin/backups/        lists the backups
+//	POST /api/admin/backups/        makes a backup now
+//	GET  /api/admin/backups/{name}  downloads a backup
+func backupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS, HEAD")
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/backups"), "/")
+
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET":
+		files, err := listBackups(backups.dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if name == "" {
+			if err = json.NewEncoder(w).Encode(files); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		for _, file := range files {
+			if file.Name == name {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+				http.ServeFile(w, r, filepath.Join(backups.dir, name))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case "POST":
+		if name != "" {
+			http.NotFound(w, r)
+			return
+		}
+		file, err := makeBackup(backups)
+		if err != nil {
+			log.Errorf("Backup failed: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s backed up the database", usernameFromContext(r.Context()))
+		w.WriteHeader(http.StatusCreated)
+		if err = json.NewEncoder(w).Encode(file); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Back up a migrated database with people in it, returning
+// the path of the backup
+func makeTestBackup(t *testing.T, dir string) string {
+	t.Helper()
+	s := openMigratedTestStore(t)
+	for _, username := range []string{"amy", "bob"} {
+		if _, err := s.AddPerson(username, username, "Sales", "", "", "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "backup.db")
+	if err := s.Backup(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the backup's temporary file was left behind")
+	}
+	return path
+}
+
+// Copy a file, changing it on the way
+func copyTestFile(t *testing.T, from string, to string, change func([]byte) []byte) {
+	t.Helper()
+	content, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(to, change(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run a statement against a database file
+func execTestFile(t *testing.T, path string, query string) {
+	t.Helper()
+	s, err := newSqlStore(dialectSqlite, "sqlite3", "file:"+path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the usernames in a database file
+func testFileUsernames(t *testing.T, path string) string {
+	t.Helper()
+	s, err := newSqlStore(dialectSqlite, "sqlite3", "file:"+path+"?mode=ro", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var names string
+	if err = s.db.QueryRow("SELECT group_concat(username) FROM (SELECT username FROM people ORDER BY username)").Scan(&names); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestCheckBackup(t *testing.T) {
+	dir := t.TempDir()
+	good := makeTestBackup(t, dir)
+	migrations, err := loadMigrations(dialectSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	tests := []struct {
+		name string
+		// make the file to check from the good backup
+		make func(t *testing.T, path string)
+		// why it's rejected, if it is; "-" for any reason
+		wantErr string
+	}{
+		{"a good backup", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func(b []byte) []byte { return b })
+		}, ""},
+		{"a damaged page", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func(b []byte) []byte {
+				// the second page, the first table's, is overwritten
+				copy(b[4096:], bytes.Repeat([]byte{0xff}, 512))
+				return b
+			})
+		}, "-"},
+		{"a truncated file", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func(b []byte) []byte { return b[:len(b)/2] })
+		}, "-"},
+		{"not a database", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func([]byte) []byte { return []byte("inoutboard backup\n") })
+		}, "is not a database"},
+		{"a newer schema", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func(b []byte) []byte { return b })
+			execTestFile(t, path, "INSERT INTO schema_version (version, name, applied_time) VALUES (9999, 'future', current_timestamp)")
+		}, "only knows up to"},
+		{"no schema version", func(t *testing.T, path string) {
+			copyTestFile(t, good, path, func(b []byte) []byte { return b })
+			execTestFile(t, path, "DROP TABLE schema_version")
+		}, "has no schema version"},
+		{"no file", func(t *testing.T, path string) {}, "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".db")
+			tt.make(t, path)
+			version, err := checkBackup(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkBackup = %v, want it accepted", err)
+				}
+				if version != latest {
+					t.Errorf("checkBackup version = %d, want %d", version, latest)
+				}
+				return
+			}
+			if err == nil || (tt.wantErr != "-" && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkBackup = %d, %v, want an error with %q", version, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	backup := makeTestBackup(t, dir)
+
+	// the live database, with someone else on the board
+	live := filepath.Join(dir, "inoutboard.db")
+	execTestFile(t, live, "CREATE TABLE people (username TEXT)")
+	execTestFile(t, live, "INSERT INTO people (username) VALUES ('zed')")
+
+	// a damaged backup changes nothing
+	damaged := filepath.Join(dir, "damaged.db")
+	copyTestFile(t, backup, damaged, func(b []byte) []byte { return b[:len(b)/2] })
+	if err := restoreBackup(live, damaged); err == nil {
+		t.Fatalf("a damaged backup was restored")
+	}
+	if names := testFileUsernames(t, live); names != "zed" {
+		t.Fatalf("after a failed restore, the database has %q, want zed", names)
+	}
+
+	if err := restoreBackup(live, backup); err != nil {
+		t.Fatal(err)
+	}
+	if names := testFileUsernames(t, live); names != "amy,bob" {
+		t.Errorf("the restored database has %q, want amy,bob", names)
+	}
+	kept, err := filepath.Glob(live + ".before-restore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || strings.HasSuffix(kept[0], "-wal") {
+		t.Fatalf("the old database was kept as %v, want one file", kept)
+	}
+	if names := testFileUsernames(t, kept[0]); names != "zed" {
+		t.Errorf("the kept database has %q, want zed", names)
+	}
+	if _, err = os.Stat(live + ".restore"); !os.IsNotExist(err) {
+		t.Errorf("the restore's temporary file was left behind")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the snapshots of the boards are served before
+// they are read from the database again, to pick up changes
+// made by something other than this service, eg: --update-users
+const boardSnapshotMaxAge = 30 * time.Second
+
+// A board as it was at some point, ready to serve
+type boardSnapshot struct {
+	// the version of the cache it was made in
+	version int64
+	people  []*Person
+	json    []byte
+	gzipped []byte
+	etag    string
+}
+
+// A store that keeps a snapshot of each board in memory, for
+// the screens that poll them. The snapshots are patched when
+// people are changed through the store, and thrown away when
+// anything else about them changes.
+type boardCache struct {
+	Store
+
+	// held while changing people, so the snapshots are patched
+	// in the order the changes were made
+	mutex sync.Mutex
+	// everyone on every board, or nil if they need to be read
+	// from the database again
+	people    []*Person
+	built     time.Time
+	snapshots map[string]*boardSnapshot
+	// goes up by one each time a board changes
+	version int64
+}
+
+// the board cache in front of the store, set in main
+var board *boardCache
+
+func newBoardCache(s Store) *boardCache {
+	return &boardCache{Store: s, snapshots: make(map[string]*boardSnapshot)}
+}
+
+// Get the current snapshot of a board, reading everyone from
+// the database if they haven't been or it was too long ago.
+// A board with nobody on it has an empty snapshot.
+func (c *boardCache) Snapshot(name string) (*boardSnapshot, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if snapshot, ok := c.snapshots[name]; ok {
+		return snapshot, nil
+	}
+	return c.publishBoard(name, make([]*Person, 0))
+}
+
+// The board someone is on, or the default board if they
+// aren't on one
+func (c *boardCache) BoardOf(username string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.load(); err != nil {
+		return "", err
+	}
+	for _, p := range c.people {
+		if strings.EqualFold(p.Username, username) {
+			return p.Board, nil
+		}
+	}
+	return defaultBoard, nil
+}
+
+// Read everyone from the database if they haven't been
+// or it was too long ago. Must be called with the mutex held.
+func (c *boardCache) load() error {
+	if c.people != nil && time.Since(c.built) < boardSnapshotMaxAge {
+		return nil
+	}
+	people, err := c.Store.GetUsers()
+	if err != nil {
+		return err
+	}
+	return c.publish(people)
+}
+
+// Make snapshots of each board from everyone on them. Boards
+// that haven't changed keep the snapshot they had. Must be
+// called with the mutex held.
+func (c *boardCache) publish(people []*Person) error {
+	byBoard := make(map[string][]*Person)
+	for _, b := range boards.list {
+		byBoard[b.Name] = make([]*Person, 0)
+	}
+	for _, p := range people {
+		byBoard[p.Board] = append(byBoard[p.Board], p)
+	}
+	for name, onBoard := range byBoard {
+		if _, err := c.publishBoard(name, onBoard); err != nil {
+			return err
+		}
+	}
+	// boards nobody is on any more
+	for name := range c.snapshots {
+		if _, ok := byBoard[name]; !ok {
+			delete(c.snapshots, name)
+		}
+	}
+	c.people = people
+	c.built = time.Now()
+	return nil
+}
+
+// Make a snapshot of the people on a board the current one,
+// unless it's the same as the last one. Must be called with
+// the mutex held.
+func (c *boardCache) publishBoard(name string, people []*Person) (*boardSnapshot, error) {
+	body, err := json.Marshal(people)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, '\n')
+	etag := etagOf(body)
+	if snapshot, ok := c.snapshots[name]; ok && snapshot.etag == etag {
+		return snapshot, nil
+	}
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err = zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	c.version++
+	snapshot := &boardSnapshot{
+		version: c.version,
+		people:  people,
+		json:    body,
+		gzipped: gzipped.Bytes(),
+		etag:    etag,
+	}
+	c.snapshots[name] = snapshot
+	log.Debugf("Snapshot %d of the %s board has %d people", c.version, name, len(people))
+	return snapshot, nil
+}
+
+// the ETag of a board's JSON
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Make new snapshots of the boards a person was and now is
+// on, read from the database again so that they're in the
+// same order as GetUsers. A nil person has been removed.
+// Must be called with the mutex held.
+func (c *boardCache) patch(username string, person *Person) {
+	if c.people == nil {
+		return
+	}
+	changed := make(map[string]bool)
+	for _, p := range c.people {
+		if strings.EqualFold(p.Username, username) {
+			changed[p.Board] = true
+		}
+	}
+	if person != nil && !person.IsDeleted {
+		if person.Board == "" {
+			changed[defaultBoard] = true
+		} else {
+			changed[person.Board] = true
+		}
+	}
+	people := make([]*Person, 0, len(c.people)+1)
+	for _, p := range c.people {
+		if !changed[p.Board] {
+			people = append(people, p)
+		}
+	}
+	for name := range changed {
+		onBoard, err := c.Store.GetBoardUsers(name)
+		if err == nil {
+			_, err = c.publishBoard(name, onBoard)
+		}
+		if err != nil {
+			log.Errorf("Could not update the snapshot of the %s board: %s", name, err)
+			// read everyone next time
+			c.people = nil
+			return
+		}
+		people = append(people, onBoard...)
+	}
+	// patching doesn't pick up changes made elsewhere, so
+	// the time they were built is kept
+	c.people = people
+}
+
+// Patch the snapshots with a person as they now are in the
+// database. Must be called with the mutex held.
+func (c *boardCache) refresh(username string) {
+	if c.people == nil {
+		return
+	}
+	person, err := c.Store.GetPerson(username)
+	if err != nil {
+		// read everyone next time
+		c.people = nil
+		return
+	}
+	c.patch(username, person)
+}
+
+// Read everyone again next time, for changes that can't be
+// patched. Boards that turn out not to have changed keep
+// their snapshots.
+func (c *boardCache) invalidate() {
+	c.mutex.Lock()
+	c.people = nil
+	c.mutex.Unlock()
+}
+
+func (c *boardCache) AddPerson(username string, name string, department string, telephone string, mobile string, office string, title string, board string) (*Person, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	person, err := c.Store.AddPerson(username, name, department, telephone, mobile, office, title, board)
+	if err != nil {
+		return person, err
+	}
+	c.patch(username, person)
+	return person, nil
+}
+
+func (c *boardCache) SetPerson(person *Person, username string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.Store.SetPerson(person, username); err != nil {
+		return err
+	}
+	c.refresh(person.Username)
+	return nil
+}
+
+func (c *boardCache) SetPersonDetails(person *Person) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.Store.SetPersonDetails(person); err != nil {
+		return err
+	}
+	c.refresh(person.Username)
+	return nil
+}
+
+func (c *boardCache) MarkLocal(username string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.Store.MarkLocal(username); err != nil {
+		return err
+	}
+	c.refresh(username)
+	return nil
+}
+
+func (c *boardCache) RemovePerson(person *Person) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.Store.RemovePerson(person); err != nil {
+		return err
+	}
+	c.patch(person.Username, nil)
+	return nil
+}
+
+func (c *boardCache) RestorePerson(username string) error {
+	defer c.invalidate()
+	return c.Store.RestorePerson(username)
+}
+
+func (c *boardCache) PurgePerson(username string) error {
+	defer c.invalidate()
+	return c.Store.PurgePerson(username)
+}
+
+func (c *boardCache) ImportBoard(b *BoardExport, conflict string) (*ImportResult, error) {
+	defer c.invalidate()
+	return c.Store.ImportBoard(b, conflict)
+}
+
+// Serve a snapshot of a board, compressed if the client
+// accepts it, or 304 Not Modified if the client already has it.
+// The compressed board has its own ETag.
+func (snapshot *boardSnapshot) serve(w http.ResponseWriter, r *http.Request) {
+	gzipETag := strings.TrimSuffix(snapshot.etag, `"`) + `-gzip"`
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" {
+				tag = snapshot.etag
+			}
+			if tag == snapshot.etag || tag == gzipETag {
+				w.Header().Set("ETag", tag)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Encoding")
+	body := snapshot.json
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", gzipETag)
+		body = snapshot.gzipped
+	} else {
+		w.Header().Set("ETag", snapshot.etag)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(body)
+}
+
+// whether a request's Accept-Encoding allows gzip, ie: lists
+// it without a quality of 0
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZip", true},
+		{"deflate, gzip", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip; q=0.001", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0", false},
+		{"gzip;q=0.0", false},
+		{"gzip;q=0.000", false},
+		{"gzip;q=nonsense", false},
+		{"deflate, br", false},
+		{"x-gzip", false},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/people/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoardSnapshotServe(t *testing.T) {
+	c := newBoardCache(nil)
+	snapshot, err := c.publishBoard(defaultBoard, []*Person{{Username: "bob", Name: "Bob Smith", Board: defaultBoard}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := snapshot.etag
+	gzipETag := etag[:len(etag)-1] + `-gzip"`
+
+	tests := []struct {
+		name           string
+		method         string
+		ifNoneMatch    string
+		acceptEncoding string
+		code           int
+		etag           string
+		gzipped        bool
+		body           bool
+	}{
+		{"plain", "GET", "", "", http.StatusOK, etag, false, true},
+		{"gzipped", "GET", "", "gzip", http.StatusOK, gzipETag, true, true},
+		{"head", "HEAD", "", "", http.StatusOK, etag, false, false},
+		{"the same etag", "GET", etag, "", http.StatusNotModified, etag, false, false},
+		{"the same gzip etag", "GET", gzipETag, "gzip", http.StatusNotModified, gzipETag, false, false},
+		{"a weak etag", "GET", "W/" + etag, "", http.StatusNotModified, etag, false, false},
+		{"one of several etags", "GET", `"old", ` + etag, "", http.StatusNotModified, etag, false, false},
+		{"any etag", "GET", "*", "", http.StatusNotModified, etag, false, false},
+		{"another etag", "GET", `"old"`, "", http.StatusOK, etag, false, true},
+		{"another etag, gzipped", "GET", `"old"`, "gzip", http.StatusOK, gzipETag, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/people/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			snapshot.serve(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag = %s, want %s", got, tt.etag)
+			}
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+				t.Errorf("gzipped = %v, want %v", got, tt.gzipped)
+			}
+			if !tt.body {
+				if w.Body.Len() > 0 {
+					t.Errorf("got a body of %d bytes, want none", w.Body.Len())
+				}
+				return
+			}
+			body := w.Body.Bytes()
+			if tt.gzipped {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(body, snapshot.json) {
+				t.Errorf("body = %s, want %s", body, snapshot.json)
+			}
+		})
+	}
+}
+
+func TestBoardCachePatch(t *testing.T) {
+	s := useTestStore(t)
+	previous := boards
+	boards = boardSettings{
+		list:   []*Board{{Name: defaultBoard}, {Name: "north"}, {Name: "south"}},
+		values: map[string]string{defaultBoard: defaultBoard, "north": "north", "south": "south"},
+	}
+	t.Cleanup(func() { boards = previous })
+
+	for _, p := range []*Person{
+		{Username: "zed", Name: "Zed", Department: "Sales", Board: defaultBoard},
+		{Username: "amy", Name: "Amy", Department: "Sales", Board: defaultBoard},
+		{Username: "cat", Name: "Cat", Department: "Support", Board: "north"},
+		{Username: "dan", Name: "Dan", Department: "Support", Board: "south"},
+	} {
+		if _, err := s.AddPerson(p.Username, p.Name, p.Department, "", "", "", "", p.Board); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newBoardCache(s)
+	usernames := func(name string) []string {
+		snapshot, err := c.Snapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(snapshot.people))
+		for _, p := range snapshot.people {
+			names = append(names, p.Username)
+		}
+		return names
+	}
+	version := func(name string) int64 {
+		snapshot, err := c.Snapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshot.version
+	}
+	south := version("south")
+
+	get := func(username string) *Person {
+		p, err := s.GetPerson(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	steps := []struct {
+		name   string
+		change func() error
+		want   map[string][]string
+	}{
+		{"as read", func() error { return nil },
+			map[string][]string{defaultBoard: {"amy", "zed"}, "north": {"cat"}, "south": {"dan"}}},
+		{"a change of department", func() error {
+			p := get("zed")
+			p.Department = "Admin"
+			return c.SetPersonDetails(p)
+		}, map[string][]string{defaultBoard: {"zed", "amy"}, "north": {"cat"}, "south": {"dan"}}},
+		{"a move to another board", func() error {
+			p := get("amy")
+			p.Board = "north"
+			return c.SetPersonDetails(p)
+		}, map[string][]string{defaultBoard: {"zed"}, "north": {"amy", "cat"}, "south": {"dan"}}},
+		{"someone new", func() error {
+			_, err := c.AddPerson("bea", "Bea", "Sales", "", "", "", "", "north")
+			return err
+		}, map[string][]string{defaultBoard: {"zed"}, "north": {"amy", "bea", "cat"}, "south": {"dan"}}},
+		{"someone removed", func() error {
+			return c.RemovePerson(get("cat"))
+		}, map[string][]string{defaultBoard: {"zed"}, "north": {"amy", "bea"}, "south": {"dan"}}},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		for name, want := range step.want {
+			got := usernames(name)
+			if len(got) != len(want) {
+				t.Fatalf("%s: the %s board has %v, want %v", step.name, name, got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("%s: the %s board has %v, want %v", step.name, name, got, want)
+				}
+			}
+			// the same order as the database gives
+			fromStore, err := s.GetBoardUsers(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range fromStore {
+				if fromStore[i].Username != got[i] {
+					t.Fatalf("%s: the %s board is in the order %v, but the database has %s at %d", step.name, name, got, fromStore[i].Username, i)
+				}
+			}
+		}
+	}
+	if got := version("south"); got != south {
+		t.Errorf("the south board was published again, as version %d, without changing", got)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the board everyone is on when there's only one, and that
+// people whose LDAP entry doesn't pick a board are put on
+const defaultBoard = "default"
+
+// board names go in URLs and roles
+var boardNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A board, for one site
+type Board struct {
+	Name  string
+	Title string
+}
+
+// The boards, from the [Board "name"] sections of the config file
+type boardSettings struct {
+	// in order of name, including the default board
+	list []*Board
+	// the board each value of the Board LDAP attribute puts
+	// people on, by the value in lower case
+	values map[string]string
+}
+
+var boards = boardSettings{
+	list:   []*Board{{Name: defaultBoard}},
+	values: map[string]string{defaultBoard: defaultBoard},
+}
+
+// Get the boards from the config file
+func boardsFromConfig(cfg *Config) (boardSettings, error) {
+	b := boardSettings{values: make(map[string]string)}
+	if _, ok := cfg.Board[defaultBoard]; !ok {
+		b.list = append(b.list, &Board{Name: defaultBoard})
+	}
+	for name, bc := range cfg.Board {
+		if !boardNamePattern.MatchString(name) {
+			return b, fmt.Errorf("[Board \"%s\"]: board names may only have letters, digits, - and _", name)
+		}
+		b.list = append(b.list, &Board{Name: name, Title: bc.Title})
+	}
+	sort.Slice(b.list, func(i, j int) bool { return b.list[i].Name < b.list[j].Name })
+	for _, board := range b.list {
+		values := []string{board.Name}
+		if bc, ok := cfg.Board[board.Name]; ok {
+			values = append(values, bc.Value...)
+		}
+		for _, value := range values {
+			key := strings.ToLower(strings.TrimSpace(value))
+			if other, ok := b.values[key]; ok && other != board.Name {
+				return b, fmt.Errorf("[Board \"%s\"]: %q already puts people on the %s board", board.Name, value, other)
+			}
+			b.values[key] = board.Name
+		}
+	}
+	return b, nil
+}
+
+// Find a board by its name
+func (b boardSettings) find(name string) *Board {
+	for _, board := range b.list {
+		if board.Name == name {
+			return board
+		}
+	}
+	return nil
+}
+
+// The board a value of the Board LDAP attribute puts
+// someone on. Values that match no board, or no value,
+// put them on the default board.
+func (b boardSettings) assign(value string) string {
+	if name, ok := b.values[strings.ToLower(strings.TrimSpace(value))]; ok {
+		return name
+	}
+	return defaultBoard
+}
+
+// returned when a status code that's in use is removed
+var errStatusInUse = errors.New("the status is in use")
+
+// Add a status code for one board
+func (s *sqlStore) AddStatus(board string, value string) (*Status, error) {
+	status := &Status{Value: value, Board: board}
+	if err := s.queryRow("INSERT INTO status (value, board) VALUES (?, ?) RETURNING id", value, board).Scan(&status.Code); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.statusCodes = nil
+	s.mutex.Unlock()
+	return status, nil
+}
+
+// Remove a status code from a board, unless anyone has it,
+// including people who have been removed from the board.
+// Returns sql.ErrNoRows if the board has no such code of its
+// own; codes on every board can't be removed.
+func (s *sqlStore) RemoveStatus(board string, code int) error {
+	res, err := s.exec("DELETE FROM status WHERE id = ? AND board = ? AND NOT EXISTS (SELECT 1 FROM people WHERE status = ?)", code, board, code)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		var exists int
+		err = s.queryRow("SELECT count(*) FROM status WHERE id = ? AND board = ?", code, board).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errStatusInUse
+		}
+		return sql.ErrNoRows
+	}
+	s.mutex.Lock()
+	s.statusCodes = nil
+	s.mutex.Unlock()
+	return nil
+}
+
+// The status codes people on a board can have, in order:
+// the codes on every board, and the board's own
+func boardStatusCodes(board string) ([]Status, error) {
+	codes, err := store.StatusCodes()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(codes))
+	for _, status := range codes {
+		if status.Board == "" || status.Board == board {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Code < statuses[j].Code })
+	return statuses, nil
+}
+
+// Whether someone on a board may have a status: one on every
+// board or the board's own, or 0 for no status yet. Codes
+// that aren't known aren't allowed.
+func statusAllowed(codes map[int]Status, code int, board string) bool {
+	if code == 0 {
+		return true
+	}
+	status, ok := codes[code]
+	return ok && (status.Board == "" || status.Board == board)
+}
+
+// A board in the list of boards
+type BoardSummary struct {
+	Name   string
+	Title  string
+	People int
+	// whether the user is an admin of the board
+	Admin bool
+}
+
+// The boards and what's on them:
+//
+//	GET    /api/boards/                            lists the boards
+//	GET    /api/boards/{board}/people              the people on a board
+//	GET    /api/boards/{board}/departments         the departments on a board
+//	GET    /api/boards/{board}/statuscodes         the status codes people on a board can have
+//	POST   /api/boards/{board}/statuscodes         adds a status code to a board
+//	DELETE /api/boards/{board}/statuscodes/{code}  removes one of a board's own status codes
+//
+// Adding and removing status codes is for admins of the board.
+func boardsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS, HEAD")
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/boards"), "/")
+	name, rest, _ := strings.Cut(path, "/")
+	what, code, _ := strings.Cut(rest, "/")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !hasScope(r.Context(), ScopePeopleRead) {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	if name == "" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		summaries := make([]*BoardSummary, 0, len(boards.list))
+		for _, b := range boards.list {
+			snapshot, err := board.Snapshot(b.Name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			summaries = append(summaries, &BoardSummary{Name: b.Name, Title: b.Title, People: len(snapshot.people), Admin: isBoardAdmin(r.Context(), b.Name)})
+		}
+		if err := json.NewEncoder(w).Encode(summaries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if boards.find(name) == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case what == "people" && code == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		snapshot, err := board.Snapshot(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Debugf("Serving board snapshot %d of %s, with %d people", snapshot.version, name, len(snapshot.people))
+		snapshot.serve(w, r)
+	case what == "departments" && code == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		snapshot, err := board.Snapshot(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		departments := make([]string, 0)
+		for _, p := range snapshot.people {
+			// the snapshot is in order of department
+			if p.Department != "" && (len(departments) == 0 || departments[len(departments)-1] != p.Department) {
+				departments = append(departments, p.Department)
+			}
+		}
+		if err = json.NewEncoder(w).Encode(departments); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case what == "statuscodes" && code == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		statuses, err := boardStatusCodes(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = json.NewEncoder(w).Encode(statuses); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case what == "statuscodes" && code == "" && r.Method == "POST":
+		if !requireBoardAdmin(w, r, name) {
+			return
+		}
+		var status Status
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status.Value = strings.TrimSpace(status.Value)
+		if status.Value == "" {
+			http.Error(w, "the status has no Value", http.StatusBadRequest)
+			return
+		}
+		statuses, err := boardStatusCodes(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, existing := range statuses {
+			if strings.EqualFold(existing.Value, status.Value) {
+				http.Error(w, fmt.Sprintf("the %s board already has the status %q", name, existing.Value), http.StatusConflict)
+				return
+			}
+		}
+		added, err := store.AddStatus(name, status.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s added the status %q (%d) to the %s board", usernameFromContext(r.Context()), added.Value, added.Code, name)
+		w.WriteHeader(http.StatusCreated)
+		if err = json.NewEncoder(w).Encode(added); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case what == "statuscodes" && code != "" && r.Method == "DELETE":
+		if !requireBoardAdmin(w, r, name) {
+			return
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		err = store.RemoveStatus(name, n)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err == errStatusInUse {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s removed the status %d from the %s board", usernameFromContext(r.Context()), n, name)
+		w.WriteHeader(http.StatusNoContent)
+	case what == "people" || what == "departments" || what == "statuscodes":
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStatusAllowed(t *testing.T) {
+	codes := map[int]Status{
+		1: {Code: 1, Value: "In"},
+		2: {Code: 2, Value: "Out"},
+		4: {Code: 4, Value: "At the mill", Board: "north"},
+		5: {Code: 5, Value: "At the dock", Board: "south"},
+	}
+	tests := []struct {
+		name  string
+		code  int
+		board string
+		want  bool
+	}{
+		{"on every board", 1, defaultBoard, true},
+		{"on every board, from another board", 2, "north", true},
+		{"the board's own", 4, "north", true},
+		{"another board's", 5, "north", false},
+		{"another board's, from the default board", 4, defaultBoard, false},
+		{"no status yet", 0, "north", true},
+		{"unknown", 3, defaultBoard, false},
+		{"negative", -1, defaultBoard, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusAllowed(codes, tt.code, tt.board); got != tt.want {
+				t.Errorf("statusAllowed(%d, %q) = %v, want %v", tt.code, tt.board, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoardsFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		boards  map[string]*BoardConfig
+		names   []string
+		assign  map[string]string
+		wantErr bool
+	}{
+		{"no boards", nil, []string{defaultBoard}, map[string]string{"": defaultBoard, "anything": defaultBoard}, false},
+		{"named boards", map[string]*BoardConfig{"north": {Value: []string{"Leeds", " york "}}, "south": {}},
+			[]string{defaultBoard, "north", "south"},
+			map[string]string{"leeds": "north", "YORK": "north", "North": "north", "south": "south", "Hull": defaultBoard}, false},
+		{"a default board section", map[string]*BoardConfig{defaultBoard: {Title: "Head office", Value: []string{"London"}}},
+			[]string{defaultBoard}, map[string]string{"london": defaultBoard}, false},
+		{"a bad name", map[string]*BoardConfig{"north site": {}}, nil, nil, true},
+		{"a value on two boards", map[string]*BoardConfig{"north": {Value: []string{"Leeds"}}, "south": {Value: []string{"leeds"}}}, nil, nil, true},
+		{"a value naming another board", map[string]*BoardConfig{"north": {}, "south": {Value: []string{"North"}}}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := boardsFromConfig(&Config{Board: tt.boards})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("boardsFromConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			names := make([]string, 0, len(got.list))
+			for _, b := range got.list {
+				names = append(names, b.Name)
+			}
+			if len(names) != len(tt.names) {
+				t.Fatalf("boards = %v, want %v", names, tt.names)
+			}
+			for i := range names {
+				if names[i] != tt.names[i] {
+					t.Fatalf("boards = %v, want %v", names, tt.names)
+				}
+			}
+			for value, want := range tt.assign {
+				if board := got.assign(value); board != want {
+					t.Errorf("assign(%q) = %q, want %q", value, board, want)
+				}
+			}
+		})
+	}
+}
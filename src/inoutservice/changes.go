@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ldap.v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attributes that track when an entry last changed
+const (
+	// Active Directory's update sequence number. Each domain
+	// controller numbers its changes separately.
+	changeAttributeUSN = "uSNChanged"
+	// the standard LDAP operational attribute
+	changeAttributeTimestamp = "modifyTimestamp"
+	// turns incremental syncs off
+	changeAttributeNone = "none"
+)
+
+// hours between full syncs, when the config file doesn't say
+const defaultFullSyncHours = 24
+
+// how long an incremental sync cursor lasts before a full
+// sync is done, to catch deleted entries. Set from the config file.
+var fullSyncInterval = defaultFullSyncHours * time.Hour
+
+// Where the last sync of a directory got to, so the next
+// one only needs to read entries that have changed since
+type SyncCursor struct {
+	Directory string
+	// the attribute the value is of
+	Attribute string
+	// the latest value of the attribute seen
+	Value string
+	// the server the value came from, where the directory says
+	Server string
+	// when everyone in the directory was last read
+	FullSyncTime time.Time
+}
+
+// How a sync is run
+type syncMode struct {
+	// carry on past the safety limits
+	force bool
+	// read everyone, even if there is a cursor to start from
+	full bool
+}
+
+// Get the full sync interval from the config file
+func fullSyncIntervalFromConfig(cfg *Config) time.Duration {
+	if cfg.Sync.FullSyncHours <= 0 {
+		return defaultFullSyncHours * time.Hour
+	}
+	return time.Duration(cfg.Sync.FullSyncHours) * time.Hour
+}
+
+// Check the change attribute in a directory's config
+func parseChangeAttribute(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", strings.ToLower(changeAttributeTimestamp):
+		return changeAttributeTimestamp, nil
+	case strings.ToLower(changeAttributeUSN):
+		return changeAttributeUSN, nil
+	case changeAttributeNone:
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown LdapChangeAttribute %q", value)
+}
+
+// Get the cursor to start an incremental sync of a directory
+// from, or nil if everyone needs to be read
+func cursorFor(d *directory, full bool) *SyncCursor {
+	if d.changeAttribute == "" || full {
+		return nil
+	}
+	cursor, err := store.GetSyncCursor(d.name)
+	if err != nil {
+		log.Errorf("Could not get the sync cursor for %s: %s", d.name, err)
+		return nil
+	}
+	if cursor == nil || cursor.Attribute != d.changeAttribute || cursor.Value == "" {
+		return nil
+	}
+	if time.Since(cursor.FullSyncTime) > fullSyncInterval {
+		log.Infof("Last full sync of %s was at %s; reading everyone", d.name, cursor.FullSyncTime)
+		return nil
+	}
+	return cursor
+}
+
+// Limit a filter to entries that changed since the cursor.
+// Entries at the cursor itself are read again, which is harmless.
+func changedSince(filter string, cursor *SyncCursor) string {
+	return fmt.Sprintf("(&%s(%s>=%s))", filter, cursor.Attribute, ldap.EscapeFilter(cursor.Value))
+}
+
+// Whether a value of a change attribute is later than
+// another. Sequence numbers are compared as numbers, and
+// timestamps, which are all in the same format, as text.
+func laterChange(attribute string, value string, than string) bool {
+	if than == "" {
+		return value != ""
+	}
+	if attribute == changeAttributeUSN {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		t, err := strconv.ParseInt(than, 10, 64)
+		return err != nil || v > t
+	}
+	return value > than
+}
+
+// The name of the server a connection is to, from the root
+// DSE. Only Active Directory gives one; others give "".
+func serverName(conn *ldap.Conn) string {
+	res, err := conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"dnsHostName"}, nil))
+	if err != nil || len(res.Entries) == 0 {
+		return ""
+	}
+	return res.Entries[0].GetAttributeValue("dnsHostName")
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fields of a person that only a CSV import sets, besides
+// the ones LDAP sets
+const (
+	fieldUsername = "Username"
+	fieldStatus   = "Status"
+	fieldRemarks  = "Remarks"
+)
+
+// the largest CSV file the admin API accepts
+const maxCSVUpload = 10 << 20
+
+// Column headings each field is found under, when the
+// column mapping doesn't say. Headings are compared
+// ignoring case, spaces and underscores.
+var defaultCSVColumns = map[string][]string{
+	fieldUsername:   {"username", "login", "user", "account"},
+	fieldName:       {"name", "fullname"},
+	fieldDepartment: {"department", "dept"},
+	fieldTelephone:  {"telephone", "phone", "extension", "ext"},
+	fieldMobile:     {"mobile", "cell", "cellphone", "mobilephone"},
+	fieldOffice:     {"office", "room", "location"},
+	fieldTitle:      {"title", "jobtitle"},
+	fieldBoard:      {"board", "site"},
+	fieldStatus:     {"status", "inout"},
+	fieldRemarks:    {"remarks", "notes", "comment", "comments"},
+}
+
+// How a CSV file maps onto the board
+type CSVMapping struct {
+	// the column heading for each field, overriding the defaults
+	Columns map[string]string
+	// the status each value in the status column stands for,
+	// for values that aren't already the name of a status
+	Statuses map[string]string
+}
+
+// Parse Field=Column and Value=Status mappings, from the
+// command line or the query string
+func parseCSVMapping(columns []string, statuses []string) (*CSVMapping, error) {
+	m := &CSVMapping{Columns: make(map[string]string), Statuses: make(map[string]string)}
+	for _, spec := range columns {
+		field, column, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(column) == "" {
+			return nil, fmt.Errorf("%q isn't Field=Column", spec)
+		}
+		name := csvFieldName(field)
+		if name == "" {
+			return nil, fmt.Errorf("%q isn't a field; use one of %s", field, strings.Join(csvFields(), ", "))
+		}
+		m.Columns[name] = strings.TrimSpace(column)
+	}
+	for _, spec := range statuses {
+		value, status, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(status) == "" {
+			return nil, fmt.Errorf("%q isn't Value=Status", spec)
+		}
+		m.Statuses[strings.ToLower(strings.TrimSpace(value))] = strings.TrimSpace(status)
+	}
+	return m, nil
+}
+
+// the fields a CSV file can set, in the order they're reported
+func csvFields() []string {
+	return []string{fieldUsername, fieldName, fieldDepartment, fieldTelephone, fieldMobile, fieldOffice, fieldTitle, fieldBoard, fieldStatus, fieldRemarks}
+}
+
+// the field a name refers to, ignoring case, or ""
+func csvFieldName(name string) string {
+	for _, field := range csvFields() {
+		if strings.EqualFold(field, strings.TrimSpace(name)) {
+			return field
+		}
+	}
+	return ""
+}
+
+// a column heading, for comparing with the defaults
+func normalizeHeading(heading string) string {
+	heading = strings.ToLower(strings.TrimSpace(heading))
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(heading)
+}
+
+// What importing a CSV file would do, or did
+type CSVReport struct {
+	// data rows read, not counting the headings
+	Rows int
+	// the column heading used for each field
+	Columns map[string]string
+	Add     []*Person
+	Update  []*PersonUpdate
+	// rows that match the board already
+	Unchanged int
+	Rejected  []*CSVRowError
+	// whether the changes were made, or this is a preview
+	Applied bool
+	// the changes to make, with the line of each
+	changes []*csvChange
+}
+
+// Why a row of a CSV file was rejected
+type CSVRowError struct {
+	// the line in the file, counting the headings as line 1
+	Line     int
+	Username string `json:",omitempty"`
+	Errors   []string
+}
+
+// a change to make to the board for one row
+type csvChange struct {
+	line    int
+	person  *Person
+	added   bool
+	details bool
+	status  bool
+}
+
+// Read a CSV file and work out what importing it would do,
+// without changing anything. Every row is checked, and the
+// ones with problems are reported rather than stopping the
+// import. Empty cells leave a person's fields as they are.
+func planCSVImport(r io.Reader, mapping *CSVMapping) (*CSVReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	headings, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(headings) > 0 {
+		// spreadsheets often start the file with a byte order mark
+		headings[0] = strings.TrimPrefix(headings[0], "\ufeff")
+	}
+
+	// find the column for each field
+	report := &CSVReport{
+		Columns:  make(map[string]string),
+		Add:      make([]*Person, 0),
+		Update:   make([]*PersonUpdate, 0),
+		Rejected: make([]*CSVRowError, 0),
+	}
+	index := make(map[string]int)
+	for _, field := range csvFields() {
+		heading, mapped := mapping.Columns[field]
+		for i, h := range headings {
+			if mapped && strings.EqualFold(strings.TrimSpace(h), heading) {
+				index[field] = i
+			}
+			if !mapped {
+				for _, alias := range defaultCSVColumns[field] {
+					if _, found := index[field]; !found && normalizeHeading(h) == alias {
+						index[field] = i
+					}
+				}
+			}
+		}
+		if i, ok := index[field]; ok {
+			report.Columns[field] = strings.TrimSpace(headings[i])
+		} else if mapped {
+			return nil, fmt.Errorf("there is no %q column for %s", heading, field)
+		}
+	}
+	if _, ok := index[fieldUsername]; !ok {
+		return nil, errors.New("there is no username column; map one with Username=<heading>")
+	}
+
+	// the status codes, by name. Boards may each have a
+	// status with the same name.
+	codes, err := store.StatusCodes()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string][]Status)
+	names := make([]string, 0, len(codes))
+	for _, status := range codes {
+		statuses[strings.ToLower(status.Value)] = append(statuses[strings.ToLower(status.Value)], status)
+		names = append(names, status.Value)
+	}
+	sort.Strings(names)
+	findStatus := func(value string, onBoard string) (Status, bool) {
+		if mapped, ok := mapping.Statuses[strings.ToLower(value)]; ok {
+			value = mapped
+		}
+		if named, ok := statuses[strings.ToLower(value)]; ok {
+			for _, status := range named {
+				if statusAllowed(codes, status.Code, onBoard) {
+					return status, true
+				}
+			}
+			return named[0], true
+		}
+		if code, err := strconv.Atoi(value); err == nil {
+			status, ok := codes[code]
+			return status, ok
+		}
+		return Status{}, false
+	}
+
+	// the people on the board, and those who have been removed
+	people, err := store.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	board := make(map[string]*Person)
+	for _, p := range people {
+		board[strings.ToLower(p.Username)] = p
+	}
+	deleted, err := store.GetDeletedUsers()
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]bool)
+	for _, p := range deleted {
+		removed[strings.ToLower(p.Username)] = true
+	}
+
+	seen := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// a quoted cell can span lines
+		line, _ := reader.FieldPos(0)
+		report.Rows++
+		rowErr := &CSVRowError{Line: line}
+		cell := func(field string) string {
+			i, ok := index[field]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		username := cell(fieldUsername)
+		rowErr.Username = username
+		if len(record) != len(headings) {
+			rowErr.Errors = append(rowErr.Errors, fmt.Sprintf("has %d columns, but there are %d headings", len(record), len(headings)))
+		}
+		if username == "" {
+			rowErr.Errors = append(rowErr.Errors, "has no username")
+		} else if first, ok := seen[strings.ToLower(username)]; ok {
+			rowErr.Errors = append(rowErr.Errors, fmt.Sprintf("is for the same person as line %d", first))
+		} else {
+			seen[strings.ToLower(username)] = line
+		}
+		if removed[strings.ToLower(username)] {
+			rowErr.Errors = append(rowErr.Errors, "is for someone who was removed from the board; restore them first")
+		}
+		existing := board[strings.ToLower(username)]
+		if existing == nil && cell(fieldName) == "" {
+			rowErr.Errors = append(rowErr.Errors, "is for someone new, but has no name")
+		}
+		onBoard := defaultBoard
+		if existing != nil {
+			onBoard = existing.Board
+		}
+		if value := cell(fieldBoard); value != "" {
+			if boards.find(value) == nil {
+				rowErr.Errors = append(rowErr.Errors, fmt.Sprintf("has an unknown board %q", value))
+			}
+			onBoard = value
+		}
+		var status Status
+		statusValue := cell(fieldStatus)
+		if statusValue != "" {
+			var ok bool
+			if status, ok = findStatus(statusValue, onBoard); !ok {
+				rowErr.Errors = append(rowErr.Errors, fmt.Sprintf("has an unknown status %q; map it to one of %s", statusValue, strings.Join(names, ", ")))
+			} else if !statusAllowed(codes, status.Code, onBoard) {
+				rowErr.Errors = append(rowErr.Errors, fmt.Sprintf("has the status %q, which only the %s board has", status.Value, status.Board))
+			}
+		}
+		if len(rowErr.Errors) > 0 {
+			report.Rejected = append(report.Rejected, rowErr)
+			continue
+		}
+
+		// fill in the person from the row
+		person := &Person{Username: username, IsLocal: true}
+		if existing != nil {
+			copied := *existing
+			person = &copied
+		}
+		fields := []struct {
+			name  string
+			value *string
+		}{
+			{fieldName, &person.Name},
+			{fieldDepartment, &person.Department},
+			{fieldTelephone, &person.Telephone},
+			{fieldMobile, &person.Mobile},
+			{fieldOffice, &person.Office},
+			{fieldTitle, &person.Title},
+			{fieldBoard, &person.Board},
+		}
+		change := &csvChange{line: line, person: person, added: existing == nil}
+		update := &PersonUpdate{Username: username, person: person}
+		for _, field := range fields {
+			if value := cell(field.name); value != "" && value != *field.value {
+				update.Changes = append(update.Changes, FieldChange{Field: field.name, Old: *field.value, New: value})
+				*field.value = value
+				change.details = true
+			}
+		}
+		if statusValue != "" && status.Code != person.Status.Code {
+			update.Changes = append(update.Changes, FieldChange{Field: fieldStatus, Old: person.Status.Value, New: status.Value})
+			person.Status = status
+			change.status = true
+		}
+		if remarks := cell(fieldRemarks); remarks != "" && remarks != person.Remarks {
+			update.Changes = append(update.Changes, FieldChange{Field: fieldRemarks, Old: person.Remarks, New: remarks})
+			person.Remarks = remarks
+			change.status = true
+		}
+
+		switch {
+		case change.added:
+			report.Add = append(report.Add, person)
+		case len(update.Changes) > 0:
+			report.Update = append(report.Update, update)
+		default:
+			report.Unchanged++
+			continue
+		}
+		report.changes = append(report.changes, change)
+	}
+	return report, nil
+}
+
+// Make the changes in a report. New people are added as if
+// they had logged in, marked as local so that syncs don't
+// remove them if they aren't in LDAP, then given their status.
+// Rows that fail are added to the rejected rows.
+func (report *CSVReport) apply(editor string) {
+	for _, change := range report.changes {
+		p := change.person
+		var err error
+		if change.added {
+			var added *Person
+			if added, err = store.AddPerson(p.Username, p.Name, p.Department, p.Telephone, p.Mobile, p.Office, p.Title, p.Board); err == nil {
+				change.status = p.Status.Code != added.Status.Code || p.Remarks != added.Remarks
+				err = store.MarkLocal(p.Username)
+			}
+		} else if change.details {
+			err = store.SetPersonDetails(p)
+		}
+		if err == nil && change.status {
+			err = store.SetPerson(p, editor)
+		}
+		if err != nil {
+			log.Errorf("CSV import of %s failed: %s", p.Username, err)
+			report.Rejected = append(report.Rejected, &CSVRowError{Line: change.line, Username: p.Username, Errors: []string{err.Error()}})
+		}
+	}
+	report.Applied = true
+}
+
+// Write a report in a form people can read
+func (report *CSVReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Read %d rows, with columns:\n", report.Rows)
+	for _, field := range csvFields() {
+		if heading, ok := report.Columns[field]; ok {
+			fmt.Fprintf(w, "  %s <- %q\n", field, heading)
+		}
+	}
+	fmt.Fprintf(w, "Add (%d):\n", len(report.Add))
+	for _, person := range report.Add {
+		fmt.Fprintf(w, "  + %s (%s, %s)\n", person.Username, person.Name, person.Department)
+	}
+	if len(report.Add) > 0 {
+		fmt.Fprintln(w, "  People added are marked as local, so LDAP syncs won't remove them for not being in LDAP.")
+	}
+	fmt.Fprintf(w, "Update (%d):\n", len(report.Update))
+	for _, update := range report.Update {
+		fmt.Fprintf(w, "  ~ %s\n", update.Username)
+		for _, change := range update.Changes {
+			fmt.Fprintf(w, "      %s: %q -> %q\n", change.Field, change.Old, change.New)
+		}
+	}
+	fmt.Fprintf(w, "Unchanged: %d\n", report.Unchanged)
+	fmt.Fprintf(w, "Rejected (%d):\n", len(report.Rejected))
+	for _, rejected := range report.Rejected {
+		who := fmt.Sprintf("line %d", rejected.Line)
+		if rejected.Username != "" {
+			who += " (" + rejected.Username + ")"
+		}
+		fmt.Fprintf(w, "  ! %s: %s\n", who, strings.Join(rejected.Errors, "; "))
+	}
+	if !report.Applied {
+		fmt.Fprintln(w, "\nThis is a preview; nothing was changed.")
+	}
+}
+
+// Write a report as JSON
+func (report *CSVReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// Import people and their statuses from a CSV file, or just
+// show what would change with preview. This is the
+// --import-csv command.
+func importCSV(path string, mapping *CSVMapping, preview bool, asJSON bool, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := planCSVImport(f, mapping)
+	if err != nil {
+		return err
+	}
+	if !preview {
+		report.apply("")
+	}
+	if asJSON {
+		return report.WriteJSON(out)
+	}
+	report.WriteText(out)
+	return nil
+}
+
+// Import people and their statuses from a CSV file, sent as
+// the body or as the "file" field of a form:
+//
+//	POST /api/admin/import/csv?preview=true                shows what would change
+//	POST /api/admin/import/csv                             imports the file
+//	POST /api/admin/import/csv?column=Username=Login       maps a column to a field
+//	POST /api/admin/import/csv?status=Away=Out             maps a value to a status
+//
+// The report is JSON, or text with ?format=text.
+func importCSVHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "POST, OPTIONS")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "POST":
+		query := r.URL.Query()
+		mapping, err := parseCSVMapping(query["column"], query["status"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCSVUpload)
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+		report, err := planCSVImport(body, mapping)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.Get("preview") != "true" {
+			admin := usernameFromContext(r.Context())
+			report.apply(admin)
+			log.Infof("%s imported a CSV file: %d added, %d updated, %d rejected", admin, len(report.Add), len(report.Update), len(report.Rejected))
+		}
+		if query.Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			report.WriteText(w)
+			return
+		}
+		if err = report.WriteJSON(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Use a new, migrated database as the store for a test
+func useTestStore(tb testing.TB) *sqlStore {
+	tb.Helper()
+	s := openTestStore(tb)
+	if err := s.Migrate(); err != nil {
+		tb.Fatal(err)
+	}
+	previous := store
+	store = s
+	tb.Cleanup(func() { store = previous })
+	return s
+}
+
+func TestParseCSVMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		columns  []string
+		statuses []string
+		want     *CSVMapping
+		wantErr  bool
+	}{
+		{"nothing", nil, nil, &CSVMapping{Columns: map[string]string{}, Statuses: map[string]string{}}, false},
+		{"columns", []string{"username=Login", " TELEPHONE = Extension "}, nil,
+			&CSVMapping{Columns: map[string]string{fieldUsername: "Login", fieldTelephone: "Extension"}, Statuses: map[string]string{}}, false},
+		{"statuses", nil, []string{"Away=Out", " ON SITE = In Field"},
+			&CSVMapping{Columns: map[string]string{}, Statuses: map[string]string{"away": "Out", "on site": "In Field"}}, false},
+		{"a heading with =", []string{"Remarks=Notes = comments"}, nil,
+			&CSVMapping{Columns: map[string]string{fieldRemarks: "Notes = comments"}, Statuses: map[string]string{}}, false},
+		{"unknown field", []string{"Email=Mail"}, nil, nil, true},
+		{"column without =", []string{"Username"}, nil, nil, true},
+		{"empty column", []string{"Username= "}, nil, nil, true},
+		{"status without =", nil, []string{"Away"}, nil, true},
+		{"empty status", nil, []string{"Away="}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCSVMapping(tt.columns, tt.statuses)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCSVMapping error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCSVMapping = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanCSVImportColumns(t *testing.T) {
+	useTestStore(t)
+	tests := []struct {
+		name    string
+		csv     string
+		columns []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"default headings", "Login,Full Name,Dept,Phone,Cell,Room,Job Title,In/Out,Notes\n",
+			nil, map[string]string{fieldUsername: "Login", fieldName: "Full Name", fieldDepartment: "Dept",
+				fieldTelephone: "Phone", fieldMobile: "Cell", fieldOffice: "Room", fieldTitle: "Job Title", fieldRemarks: "Notes"}, false},
+		{"headings in any case and spacing", "USER_NAME,name,mobile-phone,in out\n", nil,
+			map[string]string{fieldUsername: "USER_NAME", fieldName: "name", fieldMobile: "mobile-phone", fieldStatus: "in out"}, false},
+		{"a byte order mark", "\ufeffusername,name\n", nil,
+			map[string]string{fieldUsername: "username", fieldName: "name"}, false},
+		{"the first matching column", "username,name,phone,telephone\n", nil,
+			map[string]string{fieldUsername: "username", fieldName: "name", fieldTelephone: "phone"}, false},
+		{"mapped columns", "Employee,Name,Extension\n", []string{"Username=employee", "Telephone=Extension"},
+			map[string]string{fieldUsername: "Employee", fieldName: "Name", fieldTelephone: "Extension"}, false},
+		{"a mapped column replaces the default", "username,user id,name\n", []string{"Username=User ID"},
+			map[string]string{fieldUsername: "user id", fieldName: "name"}, false},
+		{"a mapped column that isn't there", "username,name\n", []string{"Telephone=Extension"}, nil, true},
+		{"no username", "name,phone\n", nil, nil, true},
+		{"empty", "", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping, err := parseCSVMapping(tt.columns, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := planCSVImport(strings.NewReader(tt.csv), mapping)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planCSVImport error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(report.Columns, tt.want) {
+				t.Errorf("planCSVImport columns = %v, want %v", report.Columns, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanCSVImportStatuses(t *testing.T) {
+	s := useTestStore(t)
+	if _, err := s.AddPerson("bob", "Bob Smith", "Sales", "", "", "", "", defaultBoard); err != nil {
+		t.Fatal(err)
+	}
+	carol, err := s.AddPerson("carol", "Carol Jones", "Sales", "", "", "", "", defaultBoard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemovePerson(carol); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := parseCSVMapping(nil, []string{"Away=Out", "site=In Field"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		row      string
+		status   string
+		rejected string
+	}{
+		{"by name", "bob,,In", "In", ""},
+		{"by name in any case", "bob,,OUT", "Out", ""},
+		{"by code", "bob,,3", "In Field", ""},
+		{"mapped", "bob,,away", "Out", ""},
+		{"mapped in any case", "bob,,Site", "In Field", ""},
+		{"unknown", "bob,,Lunch", "", "unknown status"},
+		{"unknown code", "bob,,99", "", "unknown status"},
+		{"someone new", "dave,Dave Brown,Out", "Out", ""},
+		{"someone new without a name", "dave,,Out", "", "has no name"},
+		{"someone removed", "carol,,Out", "", "restore them first"},
+		{"no username", ",Eve,Out", "", "has no username"},
+		{"the wrong number of columns", "bob,,Out,extra", "", "has 4 columns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := planCSVImport(strings.NewReader("username,name,status\n"+tt.row+"\n"), mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rejected != "" {
+				if len(report.Rejected) != 1 || !strings.Contains(strings.Join(report.Rejected[0].Errors, "; "), tt.rejected) {
+					t.Fatalf("rejected = %+v, want a rejection for %q", report.Rejected, tt.rejected)
+				}
+				if report.Rejected[0].Line != 2 {
+					t.Errorf("rejected line = %d, want 2", report.Rejected[0].Line)
+				}
+				return
+			}
+			if len(report.Rejected) > 0 {
+				t.Fatalf("rejected = %+v", report.Rejected[0])
+			}
+			if len(report.changes) != 1 {
+				t.Fatalf("%d changes, want 1", len(report.changes))
+			}
+			if got := report.changes[0].person.Status.Value; got != tt.status {
+				t.Errorf("status = %q, want %q", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestCSVImportMarksNewPeopleLocal(t *testing.T) {
+	s := useTestStore(t)
+	if _, err := s.AddPerson("bob", "Bob Smith", "Sales", "", "", "", "", defaultBoard); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := parseCSVMapping(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := planCSVImport(strings.NewReader("username,name,department,status\nbob,,Support,Out\ndave,Dave Brown,Sales,In\n"), mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.apply("admin")
+	if len(report.Rejected) > 0 {
+		t.Fatalf("rejected = %+v", report.Rejected[0])
+	}
+	for username, want := range map[string]bool{"bob": false, "dave": true} {
+		p, err := s.GetPerson(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.IsLocal != want {
+			t.Errorf("%s IsLocal = %v, want %v", username, p.IsLocal, want)
+		}
+	}
+}
@@ -4,382 +4,659 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
-	"sync"
+	"strings"
+	"time"
 )
 
-var conn *sql.DB
-
-var statusCodes map[int]Status
-var mutex *sync.Mutex
-
-func init() {
-	mutex = &sync.Mutex{}
-}
-
-func ValidateSession(sessionID string) (string, error) {
-	stmt, err := conn.Prepare("SELECT username FROM sessions JOIN people ON (person_id = people.id) WHERE sessions.id = ?")
-	defer stmt.Close()
-	checkErr(err)
-	res, err := stmt.Query(sessionID)
-	defer res.Close()
-	checkErr(err)
+// Look up a session, returning the username and the
+// roles the user had when they logged in
+func (s *sqlStore) ValidateSession(sessionID string) (string, []string, error) {
 	var username string
-	rows := 0
-	for res.Next() {
-		if err = res.Scan(&username); err != nil {
-			return "", err
-		}
-		rows++
+	var roles string
+	err := s.queryRow("SELECT username, roles FROM sessions JOIN people ON (person_id = people.id) WHERE sessions.id = ? AND people.is_deleted = 0", sessionID).Scan(&username, &roles)
+	if err == sql.ErrNoRows {
+		return "", nil, errors.New("session not found")
 	}
-	if rows == 1 {
-		return username, nil
-	} else {
-		return "", errors.New("session not found")
+	if err != nil {
+		return "", nil, err
 	}
+	return username, strings.Fields(roles), nil
 }
 
-func CreateSession(sessionID string, userID int) error {
-	stmt, err := conn.Prepare("INSERT INTO sessions (id, person_id) VALUES (?, ?)")
-	defer stmt.Close()
-	checkErr(err)
-	stmt.Exec(sessionID, userID)
-	checkErr(err)
+func (s *sqlStore) CreateSession(sessionID string, userID int, roles []string) error {
+	_, err := s.exec("INSERT INTO sessions (id, person_id, roles) VALUES (?, ?, ?)", sessionID, userID, strings.Join(roles, " "))
 	return err
 }
 
-func RemoveSession(sessionID string) error {
-	stmt, err := conn.Prepare("DELETE FROM sessions WHERE id = ?")
-	defer stmt.Close()
-	checkErr(err)
-	_, err = stmt.Exec(sessionID)
-	checkErr(err)
+func (s *sqlStore) RemoveSession(sessionID string) error {
+	_, err := s.exec("DELETE FROM sessions WHERE id = ?", sessionID)
 	return err
 }
 
-func checkErr(err error) {
-	if err != nil {
-		log.Error(err.Error())
-		log.Error(" Noooooo!\n")
+func (s *sqlStore) AddPerson(username string, name string, department string, telephone string, mobile string, office string, title string, board string) (*Person, error) {
+	if board == "" {
+		board = defaultBoard
 	}
-}
-
-func AddPerson(username string, name string, department string, telephone string, mobile string, office string, title string) (*Person, error) {
-	stmt, err := conn.Prepare("INSERT INTO people (username, name, status, department, mobile, telephone, office, title) VALUES (?,?,?,?,?,?,?,?)")
-	defer stmt.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// there has to be a status code 0 in the db or this will fail
-	_, err = stmt.Exec(username, name, 0, department, mobile, telephone, office, title)
+	// status 0 isn't one of the status codes; it means the
+	// person hasn't set a status yet
+	_, err := s.exec("INSERT INTO people (username, name, status, department, mobile, telephone, office, title, board) VALUES (?,?,?,?,?,?,?,?,?)",
+		username, name, 0, department, mobile, telephone, office, title, board)
 	if err != nil {
 		return nil, err
 	}
 
-	person, err := GetPerson(username)
+	person, err := s.GetPerson(username)
 	log.Infof("Added %s to the db", username)
 	return person, err
 }
 
-func createDb(dbPath string) {
-	db, err := sql.Open("sqlite3", dbPath)
-	checkErr(err)
-	if err != nil {
-		log.Fatal("Could not open the database file")
-	}
-	conn = db
+// A database or a transaction
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
 
+// Bring a database made before there were migrations up
+// to the schema of the first migration, by adding the
+// tables and columns it's missing
+func upgradeLegacyDb(db sqlExecer) error {
 	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
-	defer rows.Close()
-	tables := make(map[string]string)
-	var table string
-	checkErr(err)
+	if err != nil {
+		return err
+	}
+	tables := make(map[string]bool)
 	for rows.Next() {
-		err = rows.Scan(&table)
-		checkErr(err)
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
 		log.Infof("found table %s", table)
-		tables[table] = table
-	}
-
-	if _, ok := tables["status"]; !ok {
-		log.Print("creating status table")
-		res, err := db.Exec("CREATE TABLE status (id INTEGER PRIMARY KEY, value TEXT)")
-		checkErr(err)
-		log.Print("insert status values")
-		stmt, err := db.Prepare("INSERT INTO status (value) VALUES (?)")
-		checkErr(err)
-		res, err = stmt.Exec("In")
-		rows, err := res.RowsAffected()
-		if rows == 0 {
-			panic(err)
+		tables[table] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	creates := []struct {
+		table string
+		sql   []string
+	}{
+		{"status", []string{
+			"CREATE TABLE status (id INTEGER PRIMARY KEY, value TEXT)",
+			"INSERT INTO status (value) VALUES ('In')",
+			"INSERT INTO status (value) VALUES ('Out')",
+			"INSERT INTO status (value) VALUES ('In Field')",
+		}},
+		{"people", []string{"CREATE TABLE people (id INTEGER PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT null, mobile TEXT not null default '', telephone TEXT not null default '', office TEXT not null default '', title TEXT not null default '', status int REFERENCES status(id), notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time datetime DEFAULT CURRENT_TIMESTAMP, is_deleted INTEGER NOT NULL DEFAULT 0, deleted_at DATETIME NULL)"}},
+		{"sessions", []string{"CREATE TABLE sessions (id text PRIMARY KEY, person_id INTEGER REFERENCES people(id), create_time DATETIME DEFAULT CURRENT_TIMESTAMP, roles TEXT NOT NULL DEFAULT '')"}},
+		{"api_tokens", []string{"CREATE TABLE api_tokens (id INTEGER PRIMARY KEY, person_id INTEGER REFERENCES people(id), name TEXT NOT NULL DEFAULT '', token_hash TEXT UNIQUE NOT NULL, scopes TEXT NOT NULL DEFAULT '', create_time DATETIME DEFAULT CURRENT_TIMESTAMP, expire_time DATETIME NULL, last_used DATETIME NULL)"}},
+		{"login_attempts", []string{"CREATE TABLE login_attempts (kind TEXT NOT NULL, key TEXT NOT NULL, failures INTEGER NOT NULL DEFAULT 0, last_failure DATETIME NULL, locked_until DATETIME NULL, PRIMARY KEY (kind, key))"}},
+		{"sync_runs", []string{"CREATE TABLE sync_runs (id INTEGER PRIMARY KEY, trigger TEXT NOT NULL, start_time DATETIME NOT NULL, end_time DATETIME NULL, added INTEGER NOT NULL DEFAULT 0, updated INTEGER NOT NULL DEFAULT 0, removed INTEGER NOT NULL DEFAULT 0, errors INTEGER NOT NULL DEFAULT 0, message TEXT NOT NULL DEFAULT '')"}},
+		{"sync_cursors", []string{"CREATE TABLE sync_cursors (directory TEXT PRIMARY KEY, attribute TEXT NOT NULL, value TEXT NOT NULL, server TEXT NOT NULL DEFAULT '', full_sync_time DATETIME NOT NULL)"}},
+	}
+	// columns added to tables older databases already had
+	columns := []struct {
+		table  string
+		column string
+		sql    []string
+	}{
+		{"people", "is_deleted", []string{
+			"ALTER TABLE people ADD COLUMN is_deleted INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE people ADD COLUMN deleted_at DATETIME NULL",
+		}},
+		{"sessions", "roles", []string{"ALTER TABLE sessions ADD COLUMN roles TEXT NOT NULL DEFAULT ''"}},
+	}
+
+	for _, create := range creates {
+		if tables[create.table] {
+			continue
+		}
+		log.Printf("creating %s table", create.table)
+		for _, query := range create.sql {
+			if _, err = db.Exec(query); err != nil {
+				return err
+			}
+		}
+		tables[create.table] = true
+	}
+	for _, c := range columns {
+		exists, err := columnExists(db, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		log.Printf("adding %s to the %s table", c.column, c.table)
+		for _, query := range c.sql {
+			if _, err = db.Exec(query); err != nil {
+				return err
+			}
 		}
-		checkErr(err)
-		res, err = stmt.Exec("Out")
-		checkErr(err)
-		res, err = stmt.Exec("In Field")
-		checkErr(err)
 	}
-	log.Print("creating people table")
-	if _, ok := tables["people"]; !ok {
-		_, err = db.Exec("CREATE TABLE people (id INTEGER PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT null, mobile TEXT not null default '', telephone TEXT not null default '', office TEXT not null default '', title TEXT not null default '', status int REFERENCES status(id), notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time datetime DEFAULT CURRENT_TIMESTAMP)")
-		checkErr(err)
+	return nil
+}
+
+// check whether a table has a column, for
+// upgrading older databases
+func columnExists(db sqlExecer, table string, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
 	}
-	if _, ok := tables["sessions"]; !ok {
-		log.Print("creating sessions table")
-		stmt, err := db.Prepare("CREATE TABLE sessions (id text PRIMARY KEY, person_id INTEGER REFERENCES people(id), create_time DATETIME DEFAULT CURRENT_TIMESTAMP)")
-		defer stmt.Close()
-		_, err = stmt.Exec()
-		checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var cid int
+		var name string
+		var ctype string
+		var notNull bool
+		var dflt sql.NullString
+		var pk int
+		if err = rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
 	}
+	return false, rows.Err()
 }
 
-func GetUsers() ([]*Person, error) {
+func (s *sqlStore) GetUsers() ([]*Person, error) {
 	log.Print("GetUsers")
-	if conn == nil {
-		log.Panic("Database was not open")
+	return s.getUsers("")
+}
+
+// Get the people on one board, in the same order as GetUsers
+func (s *sqlStore) GetBoardUsers(board string) ([]*Person, error) {
+	return s.getUsers("AND p.board = ?", board)
+}
+
+// get the people on the board, and matching a condition if
+// there is one, in order of department and name
+func (s *sqlStore) getUsers(where string, args ...interface{}) ([]*Person, error) {
+	statuses, err := s.StatusCodes()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the status codes: %w", err)
 	}
 
-	rows, err := conn.Query(`SELECT p.id, p.username, p.name, p.department, p.status, p.notes, p.telephone, p.mobile, p.office, p.title, l.name, p.last_edit_time
+	rows, err := s.query(`SELECT p.id, p.username, p.name, p.department, p.status, p.notes, p.telephone, p.mobile, p.office, p.title, p.board, l.name, p.last_edit_time, p.is_local
 		FROM people p
 		LEFT JOIN people l ON p.last_editor = l.id
-		ORDER BY p.department, p.name`)
-	defer rows.Close()
-	checkErr(err)
+		WHERE p.is_deleted = 0 `+where+`
+		ORDER BY p.department, p.name`, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var id int
-	var username string
-	var name string
-	var department sql.NullString
-	var notes string
-	var status int
-	var telephone string
-	var mobile string
-	var office string
-	var people []*Person
-	var lastEditor sql.NullString
-	var lastEditTime NullTime
-	var title string
-	statuses, err := StatusCodes()
-	if err != nil {
-		log.Fatalf("Failed to get status codes from the database: %s", err)
-	}
-
+	people := make([]*Person, 0)
 	for rows.Next() {
-		err = rows.Scan(
-			&id,
-			&username,
-			&name,
-			&department,
-			&status,
-			&notes,
-			&telephone,
-			&mobile,
-			&office,
-			&title,
-			&lastEditor,
-			&lastEditTime)
-		checkErr(err)
+		var p Person
+		var department sql.NullString
+		var notes sql.NullString
+		var status int
+		var lastEditor sql.NullString
+		var lastEditTime NullTime
+		err = rows.Scan(&p.ID, &p.Username, &p.Name, &department, &status, &notes,
+			&p.Telephone, &p.Mobile, &p.Office, &p.Title, &p.Board, &lastEditor, &lastEditTime, &p.IsLocal)
 		if err != nil {
 			return nil, err
 		}
-		p := &Person{
-			ID:         id,
-			Name:       name,
-			Username:   username,
-			Department: department.String,
-			Status:     statuses[status],
-			Remarks:    notes,
-			Telephone:  telephone,
-			Mobile:     mobile,
-			Office:     office,
-			Title:      title,
-			LastEditor: "",
-		}
-
+		p.Department = department.String
 		p.Status = statuses[status]
-
-		if lastEditor.Valid {
-			p.LastEditor = lastEditor.String
-		}
+		p.Remarks = notes.String
+		p.LastEditor = lastEditor.String
 		if lastEditTime.Valid {
 			p.LastEditTime = lastEditTime.Time.Local()
 		}
-		people = append(people, p)
+		people = append(people, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 	log.Debugf("Got %d people from the db\n", len(people))
-	rows.Close()
-
 	return people, nil
 }
 
-func GetPerson(username string) (*Person, error) {
+func (s *sqlStore) GetPerson(username string) (*Person, error) {
 	log.Print("GetPerson")
-	if conn == nil {
-		log.Panic("Database was not open")
+	statuses, err := s.StatusCodes()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the status codes: %w", err)
 	}
-	var person *Person
-	var id int
-	var uname string
-	var name string
+
+	person := &Person{Username: username}
+	var department sql.NullString
+	var notes sql.NullString
 	var status int
-	var notes string
-	var department string
-	var office sql.NullString
 	var telephone sql.NullString
 	var mobile sql.NullString
-	var title string
+	var office sql.NullString
 	var lastEditor sql.NullString
 	var lastEditTime NullTime
+	var deletedAt NullTime
+	err = s.queryRow(`SELECT p.id, p.name, p.department, p.status, p.notes, p.telephone, p.mobile, p.office, p.title, p.board, l.name as last_editor, p.last_edit_time, p.is_deleted, p.is_local, p.deleted_at
+	FROM people p left join people l on l.id = p.last_editor WHERE p.username = ?`, username).Scan(
+		&person.ID, &person.Name, &department, &status, &notes, &telephone, &mobile, &office, &person.Title, &person.Board,
+		&lastEditor, &lastEditTime, &person.IsDeleted, &person.IsLocal, &deletedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("No user named %s", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	person.Department = department.String
+	person.Status = statuses[status]
+	person.Remarks = notes.String
+	person.Telephone = telephone.String
+	person.Mobile = mobile.String
+	person.Office = office.String
+	person.LastEditor = lastEditor.String
+	if lastEditTime.Valid {
+		person.LastEditTime = lastEditTime.Time.Local()
+	}
+	if deletedAt.Valid {
+		deleted := deletedAt.Time.Local()
+		person.DeletedAt = &deleted
+	}
+	return person, nil
+}
+
+func (s *sqlStore) SetPerson(person *Person, username string) error {
+	res, err := s.exec("UPDATE people SET status = ?, notes = ?, last_editor = (select id from people where username = ?), last_edit_time = current_timestamp WHERE username = ?",
+		person.Status.Code, person.Remarks, username, person.Username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("Failed to update user %s", person.Username)
+	}
+	return nil
+}
+
+// Updates details for a user. This is meant to be used
+// internally for attributes that are not editable by
+// the user.
+func (s *sqlStore) SetPersonDetails(person *Person) error {
+	board := person.Board
+	if board == "" {
+		board = defaultBoard
+	}
+	res, err := s.exec("UPDATE people SET name = ?, department = ?, telephone = ?, mobile = ?, office = ?, title = ?, board = ? WHERE username = ?",
+		person.Name, person.Department, person.Telephone, person.Mobile, person.Office, person.Title, board, person.Username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("Failed to update user %s", person.Username)
+	}
+	return nil
+}
+
+// Mark someone as added by hand rather than from LDAP, so
+// syncs don't remove them for not being in LDAP
+func (s *sqlStore) MarkLocal(username string) error {
+	res, err := s.exec("UPDATE people SET is_local = 1 WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("Failed to update user %s", username)
+	}
+	return nil
+}
+
+// Get the status codes, by code. They are read from the
+// database once, and cached.
+func (s *sqlStore) StatusCodes() (map[int]Status, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.statusCodes) > 0 {
+		return s.statusCodes, nil
+	}
+
+	rows, err := s.query("SELECT id, value, board FROM status")
+	if err != nil {
+		return make(map[int]Status), err
+	}
+	defer rows.Close()
+	codes := make(map[int]Status)
+	for rows.Next() {
+		var status Status
+		var value sql.NullString
+		var board sql.NullString
+		if err = rows.Scan(&status.Code, &value, &board); err != nil {
+			return make(map[int]Status), err
+		}
+		status.Value = value.String
+		status.Board = board.String
+		codes[status.Code] = status
+	}
+	if err = rows.Err(); err != nil {
+		return make(map[int]Status), err
+	}
+	s.statusCodes = codes
+	return codes, nil
+}
 
-	stmt, err := conn.Prepare(`SELECT p.id, p.username, p.name, p.department, p.status, p.notes, p.telephone, p.mobile, p.office, p.title, l.name as last_editor, p.last_edit_time
-	FROM people p left join people l on l.id = p.last_editor WHERE p.username = ?`)
-	defer stmt.Close()
-	checkErr(err)
+// Remove a person from the board. They are only marked
+// as deleted, and can be restored or purged later.
+func (s *sqlStore) RemovePerson(person *Person) error {
+	_, err := s.exec("UPDATE people SET is_deleted = 1, deleted_at = current_timestamp WHERE username = ? AND is_deleted = 0", person.Username)
+	return err
+}
+
+// Get the people who have been removed from the board,
+// most recently removed first
+func (s *sqlStore) GetDeletedUsers() ([]*Person, error) {
+	rows, err := s.query("SELECT id, username, name, department, title, board, deleted_at FROM people WHERE is_deleted = 1 ORDER BY deleted_at DESC")
 	if err != nil {
 		return nil, err
 	}
-	rows, err := stmt.Query(username)
 	defer rows.Close()
-	checkErr(err)
+
+	people := make([]*Person, 0)
+	for rows.Next() {
+		var department sql.NullString
+		var deletedAt NullTime
+		p := &Person{IsDeleted: true}
+		if err = rows.Scan(&p.ID, &p.Username, &p.Name, &department, &p.Title, &p.Board, &deletedAt); err != nil {
+			return nil, err
+		}
+		p.Department = department.String
+		if deletedAt.Valid {
+			deleted := deletedAt.Time.Local()
+			p.DeletedAt = &deleted
+		}
+		people = append(people, p)
+	}
+	return people, rows.Err()
+}
+
+// Put a removed person back on the board. Returns
+// sql.ErrNoRows if there is no such removed person.
+func (s *sqlStore) RestorePerson(username string) error {
+	res, err := s.exec("UPDATE people SET is_deleted = 0, deleted_at = NULL WHERE username = ? AND is_deleted = 1", username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Permanently delete a removed person, with their sessions
+// and API tokens. Their edits to other people's statuses are
+// kept, without an editor. Returns sql.ErrNoRows if there is
+// no such removed person.
+func (s *sqlStore) PurgePerson(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(s.rebind("SELECT id FROM people WHERE username = ? AND is_deleted = 1"), username).Scan(&id)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE person_id = ?",
+		"DELETE FROM api_tokens WHERE person_id = ?",
+		"UPDATE people SET last_editor = NULL WHERE last_editor = ?",
+		"DELETE FROM people WHERE id = ?",
+	} {
+		if _, err = tx.Exec(s.rebind(query), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Store a new API token for a user. Only the hash of
+// the token is kept in the database.
+func (s *sqlStore) CreateToken(username string, name string, tokenHash string, scopes []string, expires NullTime) (*APIToken, error) {
+	var id int
+	err := s.queryRow("INSERT INTO api_tokens (person_id, name, token_hash, scopes, expire_time) VALUES ((SELECT id FROM people WHERE username = ?), ?, ?, ?, ?) RETURNING id",
+		username, name, tokenHash, strings.Join(scopes, " "), expires).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
-	statuses, err := StatusCodes()
+	return s.GetToken(username, id)
+}
+
+// Look up a token by its hash, returning the username
+// and scopes it grants. Expired tokens are not valid.
+func (s *sqlStore) ValidateToken(tokenHash string) (string, []string, error) {
+	var id int
+	var username string
+	var scopes string
+	var expires NullTime
+	err := s.queryRow("SELECT api_tokens.id, username, scopes, expire_time FROM api_tokens JOIN people ON (person_id = people.id) WHERE token_hash = ? AND people.is_deleted = 0",
+		tokenHash).Scan(&id, &username, &scopes, &expires)
+	if err == sql.ErrNoRows {
+		return "", nil, errors.New("token not found")
+	}
 	if err != nil {
-		log.Fatalf("Could not get status codes from the database: %s", err)
+		return "", nil, err
 	}
+	if expires.Valid && expires.Time.Before(time.Now()) {
+		return "", nil, errors.New("token expired")
+	}
+	if _, err = s.exec("UPDATE api_tokens SET last_used = current_timestamp WHERE id = ?", id); err != nil {
+		log.Warnf("Could not update last use of token %d: %s", id, err)
+	}
+	return username, strings.Fields(scopes), nil
+}
 
-	if rows.Next() {
-		err = rows.Scan(&id, &uname, &name, &department, &status, &notes, &telephone, &mobile, &office, &title, &lastEditor, &lastEditTime)
-		checkErr(err)
+// Get all of the API tokens belonging to a user
+func (s *sqlStore) GetTokens(username string) ([]*APIToken, error) {
+	rows, err := s.query(`SELECT t.id, t.name, t.scopes, t.create_time, t.expire_time, t.last_used
+	FROM api_tokens t JOIN people p ON (t.person_id = p.id) WHERE p.username = ? ORDER BY t.id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*APIToken, 0)
+	for rows.Next() {
+		token, err := scanToken(rows)
 		if err != nil {
 			return nil, err
 		}
-		person = &Person{
-			ID:         id,
-			Name:       name,
-			Username:   username,
-			Department: department,
-			Title:      title,
-			Remarks:    notes,
-		}
-		person.Status = statuses[status]
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
 
-		if lastEditor.Valid {
-			person.LastEditor = lastEditor.String
-		}
-		if lastEditTime.Valid {
-			person.LastEditTime = lastEditTime.Time.Local()
-		}
-		if telephone.Valid {
-			person.Telephone = telephone.String
-		}
-		if mobile.Valid {
-			person.Mobile = mobile.String
-		}
-		if office.Valid {
-			person.Office = office.String
+// Get a single API token belonging to a user
+func (s *sqlStore) GetToken(username string, id int) (*APIToken, error) {
+	rows, err := s.query(`SELECT t.id, t.name, t.scopes, t.create_time, t.expire_time, t.last_used
+	FROM api_tokens t JOIN people p ON (t.person_id = p.id) WHERE p.username = ? AND t.id = ?`, username, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
 		}
-	} else {
-		err = fmt.Errorf("No user named %s", username)
-		person = nil
+		return nil, fmt.Errorf("No token %d for %s", id, username)
 	}
-	rows.Close()
-
-	return person, err
+	return scanToken(rows)
 }
 
-func SetPerson(person *Person, username string) error {
-	stmt, err := conn.Prepare("UPDATE people SET status = ?, notes = ?, last_editor = (select id from people where username = ?), last_edit_time = current_timestamp WHERE username = ?")
-	defer stmt.Close()
-	checkErr(err)
-	res, err := stmt.Exec(person.Status.Code, person.Remarks, username, person.Username)
-	checkErr(err)
+func scanToken(rows *sql.Rows) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	var created NullTime
+	var expires NullTime
+	var lastUsed NullTime
+	if err := rows.Scan(&token.ID, &token.Name, &scopes, &created, &expires, &lastUsed); err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if created.Valid {
+		token.CreateTime = created.Time.Local()
+	}
+	if expires.Valid {
+		t := expires.Time.Local()
+		token.Expires = &t
+	}
+	if lastUsed.Valid {
+		t := lastUsed.Time.Local()
+		token.LastUsed = &t
+	}
+	return &token, nil
+}
 
+// Revoke one of a user's API tokens
+func (s *sqlStore) RemoveToken(username string, id int) error {
+	res, err := s.exec("DELETE FROM api_tokens WHERE id = ? AND person_id = (SELECT id FROM people WHERE username = ?)", id, username)
+	if err != nil {
+		return err
+	}
 	rows, err := res.RowsAffected()
-	checkErr(err)
+	if err != nil {
+		return err
+	}
 	if rows != 1 {
-		err = fmt.Errorf("Failed to update user %s", person.Username)
-	} else {
-		err = nil
+		return fmt.Errorf("No token %d for %s", id, username)
 	}
-
-	return err
+	return nil
 }
 
-// Updates details for a user. This is meant to be used
-// internally for attributes that are not editable by
-// the user.
-func SetPersonDetails(person *Person) error {
-	stmt, err := conn.Prepare("UPDATE people SET name = ?, department = ?, telephone = ?, mobile = ?, office = ?, title = ? WHERE username = ?")
-	defer stmt.Close()
-	checkErr(err)
-	res, err := stmt.Exec(person.Name, person.Department, person.Telephone, person.Mobile, person.Office, person.Title, person.Username)
-	checkErr(err)
-	rows, err := res.RowsAffected()
-	checkErr(err)
-	if rows != 1 {
-		err = fmt.Errorf("Failed to update user %s", person.Username)
-	} else {
-		err = nil
+// Get the saved failed login attempts
+func (s *sqlStore) GetLoginAttempts() ([]*loginAttempts, error) {
+	rows, err := s.query("SELECT kind, key, failures, last_failure, locked_until FROM login_attempts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []*loginAttempts
+	for rows.Next() {
+		var a loginAttempts
+		var lastFailure NullTime
+		var lockedUntil NullTime
+		if err = rows.Scan(&a.Kind, &a.Key, &a.Failures, &lastFailure, &lockedUntil); err != nil {
+			return nil, err
+		}
+		if lastFailure.Valid {
+			a.LastFailure = lastFailure.Time
+		}
+		if lockedUntil.Valid {
+			a.LockedUntil = lockedUntil.Time
+		}
+		attempts = append(attempts, &a)
 	}
+	return attempts, rows.Err()
+}
 
+// Save the failed login attempts for a username or address
+func (s *sqlStore) SaveLoginAttempts(a *loginAttempts) error {
+	_, err := s.exec(`INSERT INTO login_attempts (kind, key, failures, last_failure, locked_until) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (kind, key) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure, locked_until = excluded.locked_until`,
+		a.Kind, a.Key, a.Failures,
+		NullTime{Time: a.LastFailure, Valid: !a.LastFailure.IsZero()},
+		NullTime{Time: a.LockedUntil, Valid: !a.LockedUntil.IsZero()})
 	return err
 }
 
-func StatusCodes() (map[int]Status, error) {
-	if statusCodes == nil {
-		statusCodes = make(map[int]Status)
-	}
-	mutex.Lock()
-	if len(statusCodes) > 0 {
-		mutex.Unlock()
-		return statusCodes, nil
+// Forget the failed login attempts for a username or address
+func (s *sqlStore) RemoveLoginAttempts(kind string, key string) error {
+	_, err := s.exec("DELETE FROM login_attempts WHERE kind = ? AND key = ?", kind, key)
+	return err
+}
+
+// Record the start of an LDAP sync, setting its ID
+func (s *sqlStore) CreateSyncRun(run *SyncRun) error {
+	return s.queryRow("INSERT INTO sync_runs (trigger, start_time) VALUES (?, ?) RETURNING id", run.Trigger, run.StartTime.UTC()).Scan(&run.ID)
+}
+
+// Record the outcome of an LDAP sync
+func (s *sqlStore) FinishSyncRun(run *SyncRun) error {
+	var end NullTime
+	if run.EndTime != nil {
+		end = NullTime{Time: run.EndTime.UTC(), Valid: true}
 	}
-	stmt, err := conn.Prepare("SELECT * FROM status")
-	defer stmt.Close()
-	checkErr(err)
+	_, err := s.exec("UPDATE sync_runs SET end_time = ?, added = ?, updated = ?, removed = ?, errors = ?, message = ? WHERE id = ?",
+		end, run.Added, run.Updated, run.Removed, run.Errors, run.Message, run.ID)
+	return err
+}
+
+// Get the most recent LDAP syncs, newest first
+func (s *sqlStore) GetSyncRuns(limit int) ([]*SyncRun, error) {
+	rows, err := s.query("SELECT id, trigger, start_time, end_time, added, updated, removed, errors, message FROM sync_runs ORDER BY id DESC LIMIT ?", limit)
 	if err != nil {
-		statusCodes = make(map[int]Status)
-		mutex.Unlock()
-		return statusCodes, err
+		return nil, err
 	}
-	rows, err := stmt.Query()
 	defer rows.Close()
-	checkErr(err)
-	if err != nil {
-		statusCodes = make(map[int]Status)
-		mutex.Unlock()
-		return statusCodes, err
-	}
 
-	var status Status
+	runs := make([]*SyncRun, 0)
 	for rows.Next() {
-		status = Status{}
-		err = rows.Scan(&status.Code, &status.Value)
-		statusCodes[status.Code] = status
-		if err != nil {
-			statusCodes = make(map[int]Status)
-			mutex.Unlock()
-			return statusCodes, err
+		var run SyncRun
+		var start NullTime
+		var end NullTime
+		if err = rows.Scan(&run.ID, &run.Trigger, &start, &end, &run.Added, &run.Updated, &run.Removed, &run.Errors, &run.Message); err != nil {
+			return nil, err
+		}
+		if start.Valid {
+			run.StartTime = start.Time.Local()
 		}
+		if end.Valid {
+			t := end.Time.Local()
+			run.EndTime = &t
+		}
+		runs = append(runs, &run)
+	}
+	return runs, rows.Err()
+}
+
+// Get where the last sync of a directory got to, or
+// nil if it hasn't been synced
+func (s *sqlStore) GetSyncCursor(directory string) (*SyncCursor, error) {
+	var cursor SyncCursor
+	var fullSync NullTime
+	err := s.queryRow("SELECT directory, attribute, value, server, full_sync_time FROM sync_cursors WHERE directory = ?", directory).Scan(
+		&cursor.Directory, &cursor.Attribute, &cursor.Value, &cursor.Server, &fullSync)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	mutex.Unlock()
-	return statusCodes, nil
+	cursor.FullSyncTime = fullSync.Time
+	return &cursor, nil
 }
 
-// Remove a person from the database
-func RemovePerson(person *Person) error {
-	stmt, err := conn.Prepare("DELETE FROM people WHERE username = ?")
-	defer stmt.Close()
-	res, err := stmt.Exec(person.Username)
-	checkErr(err)
-	_, err = res.RowsAffected()
-	checkErr(err)
+// Save where a sync of a directory got to
+func (s *sqlStore) SaveSyncCursor(cursor *SyncCursor) error {
+	_, err := s.exec(`INSERT INTO sync_cursors (directory, attribute, value, server, full_sync_time) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (directory) DO UPDATE SET attribute = excluded.attribute, value = excluded.value, server = excluded.server, full_sync_time = excluded.full_sync_time`,
+		cursor.Directory, cursor.Attribute, cursor.Value, cursor.Server, cursor.FullSyncTime.UTC())
 	return err
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// Manage people who have been removed from the board:
+//
+//	GET    /api/admin/people/deleted/                   lists them
+//	POST   /api/admin/people/deleted/{username}/restore puts one back
+//	DELETE /api/admin/people/deleted/{username}         deletes one for good
+func deletedPeopleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS, HEAD")
+	admin := usernameFromContext(r.Context())
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/people/deleted"), "/")
+
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET":
+		if path != "" {
+			http.NotFound(w, r)
+			return
+		}
+		people, err := store.GetDeletedUsers()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = json.NewEncoder(w).Encode(people); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "POST":
+		username, action, _ := strings.Cut(path, "/")
+		if username == "" || action != "restore" {
+			http.NotFound(w, r)
+			return
+		}
+		err := store.RestorePerson(username)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s restored %s to the board", admin, username)
+		person, err := store.GetPerson(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = json.NewEncoder(w).Encode(person); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "DELETE":
+		if path == "" || strings.Contains(path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		err := store.PurgePerson(path)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s purged %s", admin, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// Put amy and bob on the board, with a session and an API
+// token for bob, then remove bob
+func removeTestPerson(t *testing.T) *sqlStore {
+	t.Helper()
+	s := useTestStore(t)
+	if _, err := s.AddPerson("amy", "Amy", "Sales", "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := s.AddPerson("bob", "Bob", "Sales", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateSession("bob-session", bob.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CreateToken("bob", "script", hashToken("bob-token"), []string{ScopePeopleRead}, NullTime{}); err != nil {
+		t.Fatal(err)
+	}
+	// bob set amy's status
+	if err = s.SetPerson(&Person{Username: "amy", Status: Status{Code: 2}}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemovePerson(bob); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// the usernames of people
+func usernames(people []*Person) []string {
+	names := make([]string, 0, len(people))
+	for _, p := range people {
+		names = append(names, p.Username)
+	}
+	return names
+}
+
+// count the rows a query finds
+func countRows(t *testing.T, s *sqlStore, query string, args ...interface{}) int {
+	t.Helper()
+	var count int
+	if err := s.queryRow(query, args...).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRemovedPeopleAreHidden(t *testing.T) {
+	s := removeTestPerson(t)
+
+	people, err := s.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := usernames(people); len(names) != 1 || names[0] != "amy" {
+		t.Errorf("the board has %v, want only amy", names)
+	}
+	people, err = s.GetBoardUsers(defaultBoard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := usernames(people); len(names) != 1 || names[0] != "amy" {
+		t.Errorf("the default board has %v, want only amy", names)
+	}
+	removed, err := s.GetDeletedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Username != "bob" || removed[0].DeletedAt == nil {
+		t.Errorf("removed people = %+v, want bob, with when he was removed", removed)
+	}
+
+	// their session and token no longer work, but are kept
+	if _, _, err = s.ValidateSession("bob-session"); err == nil {
+		t.Errorf("a removed person's session is still valid")
+	}
+	if _, _, err = s.ValidateToken(hashToken("bob-token")); err == nil {
+		t.Errorf("a removed person's API token is still valid")
+	}
+	if n := countRows(t, s, "SELECT count(*) FROM sessions"); n != 1 {
+		t.Errorf("%d sessions after removing bob, want his 1", n)
+	}
+}
+
+func TestRemovedPeopleAreRestored(t *testing.T) {
+	tests := []struct {
+		name    string
+		restore func(t *testing.T) error
+		// whether bob is back on the board
+		restored bool
+	}{
+		{"logging in", func(t *testing.T) error {
+			_, err := addLdapUser(&Person{Username: "bob", Name: "Bob"})
+			return err
+		}, true},
+		{"a sync", func(t *testing.T) error {
+			run := &SyncRun{}
+			applySync(&SyncPlan{Add: []*Person{{Username: "bob", Name: "Bob"}}}, run, ioutil.Discard)
+			if run.Added != 1 || run.Errors != 0 {
+				t.Errorf("the sync added %d with %d errors, want 1 added", run.Added, run.Errors)
+			}
+			return nil
+		}, true},
+		{"an admin", func(t *testing.T) error { return store.RestorePerson("bob") }, true},
+		{"logging in while disabled in LDAP", func(t *testing.T) error {
+			_, err := addLdapUser(&Person{Username: "bob", Name: "Bob", IsDeleted: true})
+			return err
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := removeTestPerson(t)
+			if err := tt.restore(t); err != nil {
+				t.Fatal(err)
+			}
+			bob, err := s.GetPerson("bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bob.IsDeleted == tt.restored || (bob.DeletedAt == nil) != tt.restored {
+				t.Errorf("bob is removed %t since %v, want restored %t", bob.IsDeleted, bob.DeletedAt, tt.restored)
+			}
+			if n := countRows(t, s, "SELECT count(*) FROM people WHERE username = ?", "bob"); n != 1 {
+				t.Errorf("bob is in the database %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestRestoreSomeoneNotRemoved(t *testing.T) {
+	s := removeTestPerson(t)
+	if err := s.RestorePerson("amy"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("restoring someone on the board = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestPurgePerson(t *testing.T) {
+	s := removeTestPerson(t)
+	if err := s.PurgePerson("amy"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("purging someone on the board = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.PurgePerson("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		what  string
+		query string
+	}{
+		{"bob", "SELECT count(*) FROM people WHERE username = 'bob'"},
+		{"bob's sessions", "SELECT count(*) FROM sessions"},
+		{"bob's tokens", "SELECT count(*) FROM api_tokens"},
+		{"bob's edits", "SELECT count(*) FROM people WHERE last_editor IS NOT NULL"},
+	} {
+		if n := countRows(t, s, check.query); n != 0 {
+			t.Errorf("%d of %s left after purging him, want none", n, check.what)
+		}
+	}
+	// amy keeps the status bob set
+	amy, err := s.GetPerson("amy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amy.Status.Code != 2 || amy.LastEditor != "" {
+		t.Errorf("amy has status %d set by %q, want 2 with no editor", amy.Status.Code, amy.LastEditor)
+	}
+}
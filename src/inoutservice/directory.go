@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userAccountControl flag for a disabled Active Directory account
+const uacAccountDisable = 0x2
+
+// Defaults, which suit Active Directory
+const (
+	defaultUserObjectClass   = "organizationalPerson"
+	defaultUsernameAttribute = "userPrincipalName"
+	defaultDisabledRule      = "ou:OU=Previous Employees"
+)
+
+// A rule that marks a directory entry as a disabled account,
+// parsed from an LdapDisabled line in the config file:
+//
+//	ou:<text>          the entry's DN contains the text, eg: ou:OU=Previous Employees
+//	uac                the AD userAccountControl ACCOUNTDISABLE bit is set
+//	group:<dn>         the entry is a member of the group
+//	attr:<name>=<val>  the attribute has the value, or any value if val is *
+type disabledRule struct {
+	kind      string
+	attribute string
+	value     string
+}
+
+// Parse the disabled account rules from the config file
+func parseDisabledRules(lines []string) ([]disabledRule, error) {
+	if len(lines) == 0 {
+		lines = []string{defaultDisabledRule}
+	}
+	rules := make([]disabledRule, 0, len(lines))
+	for _, line := range lines {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(line), ":")
+		kind = strings.ToLower(kind)
+		switch kind {
+		case "none":
+			continue
+		case "uac":
+			rules = append(rules, disabledRule{kind: kind, attribute: "userAccountControl"})
+		case "ou":
+			if arg == "" {
+				return nil, fmt.Errorf("LdapDisabled rule %q needs a value", line)
+			}
+			rules = append(rules, disabledRule{kind: kind, value: arg})
+		case "group":
+			if arg == "" {
+				return nil, fmt.Errorf("LdapDisabled rule %q needs a value", line)
+			}
+			rules = append(rules, disabledRule{kind: kind, attribute: "memberOf", value: arg})
+		case "attr":
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("LdapDisabled rule %q should look like attr:<name>=<value>", line)
+			}
+			rules = append(rules, disabledRule{kind: kind, attribute: name, value: value})
+		default:
+			return nil, fmt.Errorf("unknown LdapDisabled rule %q", line)
+		}
+	}
+	return rules, nil
+}
+
+// whether an entry matches the rule
+func (rule disabledRule) matches(entry *ldap.Entry) bool {
+	switch rule.kind {
+	case "ou":
+		return strings.Contains(strings.ToLower(entry.DN), strings.ToLower(rule.value))
+	case "uac":
+		uac, err := strconv.ParseInt(entry.GetAttributeValue(rule.attribute), 10, 64)
+		return err == nil && uac&uacAccountDisable != 0
+	case "group":
+		for _, group := range entry.GetAttributeValues(rule.attribute) {
+			if normalizeDN(group) == normalizeDN(rule.value) {
+				return true
+			}
+		}
+	case "attr":
+		for _, value := range entry.GetAttributeValues(rule.attribute) {
+			if rule.value == "*" || strings.EqualFold(value, rule.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether an entry is a disabled account
+func isDisabled(rules []disabledRule, entry *ldap.Entry) bool {
+	for _, rule := range rules {
+		if rule.matches(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// One LDAP directory that people can log in with
+type directory struct {
+	name           string
+	realm          string
+	ldapServers    []string
+	port           int
+	username       string
+	password       string
+	ldapSearchBase string
+	mode           string
+	tlsConfig      *tls.Config
+	pool           *ldapPool
+	// how users are found and authenticated
+	bindDNTemplate    string
+	searchBind        bool
+	userFilter        string
+	userObjectClass   string
+	usernameAttribute string
+	disabledRules     []disabledRule
+	upnSuffixes       []string
+	// who is added to the board by --update-users
+	provisionFilter string
+	provisionGroups []string
+	// tracks changes for incremental syncs, or "" if they're off
+	changeAttribute string
+	// add @name to usernames that aren't already UPNs, to keep
+	// them unique across directories
+	qualify bool
+}
+
+// Set up a directory from its section of the config file
+func newDirectory(name string, cfg *DirectoryConfig, qualify bool) (*directory, error) {
+	mode, port, err := ldapModeAndPort(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newLdapTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	disabledRules, err := parseDisabledRules(cfg.LdapDisabled)
+	if err != nil {
+		return nil, err
+	}
+	changeAttribute, err := parseChangeAttribute(cfg.LdapChangeAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &directory{
+		name:              name,
+		realm:             cfg.Realm,
+		ldapServers:       cfg.LdapServer,
+		port:              port,
+		username:          cfg.Username,
+		password:          cfg.BindPassword,
+		ldapSearchBase:    cfg.LdapSearchBase,
+		mode:              mode,
+		tlsConfig:         tlsConfig,
+		bindDNTemplate:    cfg.LdapBindDN,
+		searchBind:        cfg.LdapSearchBind,
+		userFilter:        cfg.LdapUserFilter,
+		userObjectClass:   cfg.LdapUserObjectClass,
+		usernameAttribute: cfg.LdapUsernameAttribute,
+		disabledRules:     disabledRules,
+		upnSuffixes:       cfg.UPNSuffix,
+		provisionFilter:   cfg.ProvisionFilter,
+		provisionGroups:   cfg.ProvisionGroup,
+		changeAttribute:   changeAttribute,
+		qualify:           qualify,
+	}
+	if d.userObjectClass == "" {
+		d.userObjectClass = defaultUserObjectClass
+	}
+	if d.usernameAttribute == "" {
+		d.usernameAttribute = defaultUsernameAttribute
+	}
+	d.pool = newLdapPool(d, time.Duration(cfg.LdapTimeout)*time.Second, cfg.LdapRetries, cfg.LdapPoolSize)
+	return d, nil
+}
+
+// Work out which directories a username could belong to, and
+// the name to look it up by in them. DOMAIN\user picks the
+// directory by its realm or name, and user@suffix by its UPN
+// suffixes or name. Other usernames could be in any directory.
+func (o *AuthorizationOptions) directoriesFor(username string) ([]*directory, string) {
+	if domain, user, ok := strings.Cut(username, "\\"); ok {
+		for _, d := range o.directories {
+			if strings.EqualFold(d.realm, domain) || strings.EqualFold(d.name, domain) {
+				return []*directory{d}, user
+			}
+		}
+		return nil, user
+	}
+
+	if at := strings.LastIndex(username, "@"); at > 0 {
+		user, suffix := username[:at], username[at+1:]
+		for _, d := range o.directories {
+			if d.qualify && strings.EqualFold(d.name, suffix) {
+				return []*directory{d}, user
+			}
+			for _, upnSuffix := range d.upnSuffixes {
+				if strings.EqualFold(upnSuffix, suffix) {
+					return []*directory{d}, username
+				}
+			}
+		}
+	}
+	return o.directories, username
+}
+
+// The username stored in the database for a directory entry
+func (d *directory) canonicalUsername(value string) string {
+	if d.qualify && value != "" && !strings.Contains(value, "@") {
+		return value + "@" + d.name
+	}
+	return value
+}
+
+// The search filter that finds a user. The username must
+// already be escaped with SanitizeDN.
+func userFilter(d *directory, dn string) string {
+	var filter string
+	switch {
+	case d.userFilter != "":
+		filter = strings.ReplaceAll(d.userFilter, "%s", dn)
+	case strings.LastIndexAny(dn, "@") > 0:
+		filter = fmt.Sprintf("(userPrincipalName=%s)", dn)
+	default:
+		filter = fmt.Sprintf("(sAMAccountName=%s)", dn)
+	}
+	return fmt.Sprintf("(&(objectClass=%s)%s)", d.userObjectClass, filter)
+}
+
+// The name to bind as for a user, when not searching for
+// their DN first. The username must already be escaped.
+func userBindName(d *directory, dn string) string {
+	if d.bindDNTemplate != "" {
+		return strings.ReplaceAll(d.bindDNTemplate, "%s", dn)
+	}
+	if strings.LastIndexAny(dn, "@") < 0 { // not an email address
+		return d.realm + "\\" + dn
+	}
+	return dn
+}
+
+// The name the service account binds as. With no realm,
+// the username is taken to be a full DN.
+func serviceBindName(d *directory) string {
+	if d.realm == "" {
+		return d.username
+	}
+	return d.realm + "\\" + d.username
+}
+
+// The attributes to read for a user
+func userAttributes(d *directory, mappings map[string]fieldMapping) []string {
+	attributes := []string{d.usernameAttribute, "memberOf"}
+	attributes = append(attributes, mappedAttributes(mappings)...)
+	for _, rule := range d.disabledRules {
+		if rule.kind == "uac" || rule.kind == "attr" {
+			attributes = append(attributes, rule.attribute)
+		}
+	}
+	return attributes
+}
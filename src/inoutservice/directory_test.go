@@ -0,0 +1,87 @@
+package main
+
+import (
+	"gopkg.in/ldap.v2"
+	"reflect"
+	"testing"
+)
+
+func TestParseDisabledRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    []disabledRule
+		wantErr bool
+	}{
+		{"default", nil, []disabledRule{{kind: "ou", value: "OU=Previous Employees"}}, false},
+		{"none", []string{"none"}, []disabledRule{}, false},
+		{"uac", []string{"uac"}, []disabledRule{{kind: "uac", attribute: "userAccountControl"}}, false},
+		{"kind in any case", []string{" UAC "}, []disabledRule{{kind: "uac", attribute: "userAccountControl"}}, false},
+		{"ou", []string{"ou:OU=Leavers"}, []disabledRule{{kind: "ou", value: "OU=Leavers"}}, false},
+		{"group", []string{"group:CN=Disabled,DC=example,DC=com"},
+			[]disabledRule{{kind: "group", attribute: "memberOf", value: "CN=Disabled,DC=example,DC=com"}}, false},
+		{"attr", []string{"attr:nsAccountLock=true"}, []disabledRule{{kind: "attr", attribute: "nsAccountLock", value: "true"}}, false},
+		{"attr with a colon in the value", []string{"attr:description=left: 2020"},
+			[]disabledRule{{kind: "attr", attribute: "description", value: "left: 2020"}}, false},
+		{"several", []string{"uac", "attr:loginDisabled=*"},
+			[]disabledRule{{kind: "uac", attribute: "userAccountControl"}, {kind: "attr", attribute: "loginDisabled", value: "*"}}, false},
+		{"ou without a value", []string{"ou:"}, nil, true},
+		{"group without a value", []string{"group"}, nil, true},
+		{"attr without =", []string{"attr:nsAccountLock"}, nil, true},
+		{"attr without a name", []string{"attr:=true"}, nil, true},
+		{"unknown", []string{"shadowExpire"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDisabledRules(tt.lines)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDisabledRules(%q) error = %v, wantErr %v", tt.lines, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDisabledRules(%q) = %+v, want %+v", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisabledRuleMatches(t *testing.T) {
+	entry := ldap.NewEntry
+	tests := []struct {
+		name  string
+		rule  string
+		entry *ldap.Entry
+		want  bool
+	}{
+		{"ou in the DN", "ou:OU=Previous Employees",
+			entry("CN=Bob,OU=Previous Employees,DC=example,DC=com", nil), true},
+		{"ou in any case", "ou:ou=previous employees",
+			entry("CN=Bob,OU=Previous Employees,DC=example,DC=com", nil), true},
+		{"ou not in the DN", "ou:OU=Previous Employees",
+			entry("CN=Bob,OU=Staff,DC=example,DC=com", nil), false},
+		{"uac disabled", "uac", entry("CN=Bob", map[string][]string{"userAccountControl": {"514"}}), true},
+		{"uac enabled", "uac", entry("CN=Bob", map[string][]string{"userAccountControl": {"512"}}), false},
+		{"uac missing", "uac", entry("CN=Bob", nil), false},
+		{"member of the group", "group:CN=Disabled,DC=example,DC=com",
+			entry("CN=Bob", map[string][]string{"memberOf": {"CN=Staff,DC=example,DC=com", "cn=disabled, dc=example, dc=com"}}), true},
+		{"not a member of the group", "group:CN=Disabled,DC=example,DC=com",
+			entry("CN=Bob", map[string][]string{"memberOf": {"CN=Staff,DC=example,DC=com"}}), false},
+		{"attr has the value", "attr:nsAccountLock=true",
+			entry("uid=bob", map[string][]string{"nsAccountLock": {"TRUE"}}), true},
+		{"attr has another value", "attr:nsAccountLock=true",
+			entry("uid=bob", map[string][]string{"nsAccountLock": {"false"}}), false},
+		{"attr has any value", "attr:loginDisabled=*",
+			entry("uid=bob", map[string][]string{"loginDisabled": {"1"}}), true},
+		{"attr missing", "attr:loginDisabled=*", entry("uid=bob", nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseDisabledRules([]string{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules[0].matches(tt.entry); got != tt.want {
+				t.Errorf("%q matches %s = %v, want %v", tt.rule, tt.entry.DN, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Identifies an export, and the version of its format. The
+// version goes up when a change means older versions of the
+// program can't read it.
+const (
+	exportFormat  = "inoutboard-export"
+	exportVersion = 1
+)
+
+// What to do when an imported person is already on the board
+const (
+	// replace them with the imported person (the default)
+	conflictUpdate = "update"
+	// leave them as they are
+	conflictSkip = "skip"
+	// stop the import without changing anything, unless they
+	// are the same
+	conflictFail = "fail"
+)
+
+// returned when an import stops because of a conflict
+var errImportConflict = errors.New("import conflict")
+
+// The whole board, as JSON. People are matched on their
+// username when it's imported.
+type BoardExport struct {
+	Format     string
+	Version    int
+	ExportedAt time.Time
+	Statuses   []Status
+	People     []*ExportedPerson
+	// the LDAP sync history, if it was asked for
+	SyncRuns []*SyncRun `json:",omitempty"`
+}
+
+// A person in an export
+type ExportedPerson struct {
+	Username   string
+	Name       string
+	Department string
+	Telephone  string
+	Mobile     string
+	Office     string
+	Title      string
+	// the board they're on; empty is the default board
+	Board string `json:",omitempty"`
+	// the status code
+	Status  int
+	Remarks string
+	// the username of whoever last set the status
+	LastEditor   string     `json:",omitempty"`
+	LastEditTime *time.Time `json:",omitempty"`
+	Deleted      bool       `json:",omitempty"`
+	DeletedAt    *time.Time `json:",omitempty"`
+	// added by hand rather than from LDAP
+	Local bool `json:",omitempty"`
+}
+
+// What an import did
+type ImportResult struct {
+	// usernames of the people added, updated, left alone
+	// because they were already there, and unchanged
+	Added     []string
+	Updated   []string
+	Skipped   []string
+	Unchanged int
+	// status codes added or renamed
+	Statuses int
+	// LDAP syncs added to the history
+	SyncRuns int
+	// why the import stopped, with a conflict
+	Conflicts []string `json:",omitempty"`
+	// people who weren't imported, because their board or
+	// status isn't one this board has
+	Rejected []*ImportRejection
+}
+
+// A person in an import who was left out, and why
+type ImportRejection struct {
+	Username string
+	Error    string
+}
+
+// Check the conflict handling asked for
+func parseConflict(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", conflictUpdate:
+		return conflictUpdate, nil
+	case conflictSkip:
+		return conflictSkip, nil
+	case conflictFail:
+		return conflictFail, nil
+	}
+	return "", fmt.Errorf("unknown conflict handling %q; use update, skip or fail", value)
+}
+
+// Read an export, checking it's one this program understands
+func readExport(r io.Reader) (*BoardExport, error) {
+	var b BoardExport
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, fmt.Errorf("not an export: %w", err)
+	}
+	if b.Format != exportFormat {
+		return nil, errors.New("not an export: the Format is missing")
+	}
+	if b.Version < 1 || b.Version > exportVersion {
+		return nil, fmt.Errorf("the export is version %d, but this program only reads up to version %d", b.Version, exportVersion)
+	}
+	seen := make(map[string]bool)
+	for _, p := range b.People {
+		if p == nil || p.Username == "" {
+			return nil, errors.New("the export has a person without a username")
+		}
+		if seen[p.Username] {
+			return nil, fmt.Errorf("the export has %s more than once", p.Username)
+		}
+		seen[p.Username] = true
+	}
+	return &b, nil
+}
+
+// Read the whole board, including people who have been
+// removed from it, and optionally the LDAP sync history
+func (s *sqlStore) ExportBoard(history bool) (*BoardExport, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := &BoardExport{
+		Format:     exportFormat,
+		Version:    exportVersion,
+		ExportedAt: time.Now(),
+		Statuses:   make([]Status, 0),
+		People:     make([]*ExportedPerson, 0),
+	}
+	rows, err := tx.Query("SELECT id, value, board FROM status ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var status Status
+		var value, board sql.NullString
+		if err = rows.Scan(&status.Code, &value, &board); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		status.Value = value.String
+		status.Board = board.String
+		b.Statuses = append(b.Statuses, status)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT p.username, p.name, p.department, p.telephone, p.mobile, p.office, p.title, p.board, p.status, p.notes, l.username, p.last_edit_time, p.is_deleted, p.deleted_at, p.is_local
+		FROM people p
+		LEFT JOIN people l ON p.last_editor = l.id
+		ORDER BY p.username`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p ExportedPerson
+		var department, notes, lastEditor sql.NullString
+		var status sql.NullInt64
+		var lastEditTime, deletedAt NullTime
+		if err = rows.Scan(&p.Username, &p.Name, &department, &p.Telephone, &p.Mobile, &p.Office, &p.Title, &p.Board, &status, &notes, &lastEditor, &lastEditTime, &p.Deleted, &deletedAt, &p.Local); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if p.Board == defaultBoard {
+			p.Board = ""
+		}
+		p.Department = department.String
+		p.Status = int(status.Int64)
+		p.Remarks = notes.String
+		p.LastEditor = lastEditor.String
+		if lastEditTime.Valid {
+			t := lastEditTime.Time.UTC()
+			p.LastEditTime = &t
+		}
+		if deletedAt.Valid {
+			t := deletedAt.Time.UTC()
+			p.DeletedAt = &t
+		}
+		b.People = append(b.People, &p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if history {
+		rows, err = tx.Query("SELECT trigger, start_time, end_time, added, updated, removed, errors, message FROM sync_runs ORDER BY id")
+		if err != nil {
+			return nil, err
+		}
+		b.SyncRuns = make([]*SyncRun, 0)
+		for rows.Next() {
+			var run SyncRun
+			var start, end NullTime
+			if err = rows.Scan(&run.Trigger, &start, &end, &run.Added, &run.Updated, &run.Removed, &run.Errors, &run.Message); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			run.StartTime = start.Time.UTC()
+			if end.Valid {
+				t := end.Time.UTC()
+				run.EndTime = &t
+			}
+			b.SyncRuns = append(b.SyncRuns, &run)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return b, tx.Commit()
+}
+
+// Import a board, in one transaction. People already on the
+// board are matched on their username, and handled as conflict
+// says. People on a board that isn't configured, or with a
+// status their board doesn't have, are left out and reported.
+// Importing the same export again changes nothing.
+func (s *sqlStore) ImportBoard(b *BoardExport, conflict string) (*ImportResult, error) {
+	result := &ImportResult{Added: make([]string, 0), Updated: make([]string, 0), Skipped: make([]string, 0), Rejected: make([]*ImportRejection, 0)}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// status codes
+	existing := make(map[int]Status)
+	rows, err := tx.Query("SELECT id, value, board FROM status")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var status Status
+		var value, board sql.NullString
+		if err = rows.Scan(&status.Code, &value, &board); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		status.Value = value.String
+		status.Board = board.String
+		existing[status.Code] = status
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, status := range b.Statuses {
+		current, ok := existing[status.Code]
+		switch {
+		case !ok:
+			_, err = tx.Exec(s.rebind("INSERT INTO status (id, value, board) VALUES (?, ?, ?)"), status.Code, status.Value, nullString(status.Board))
+		case current == status:
+			continue
+		case conflict == conflictFail:
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("status %d is %s here, but %s in the import", status.Code, describeStatus(current), describeStatus(status)))
+			continue
+		case conflict == conflictSkip:
+			continue
+		default:
+			_, err = tx.Exec(s.rebind("UPDATE status SET value = ?, board = ? WHERE id = ?"), status.Value, nullString(status.Board), status.Code)
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing[status.Code] = status
+		result.Statuses++
+	}
+	if result.Statuses > 0 && s.dialect == dialectPostgres {
+		// status codes were given their ids, so the sequence
+		// hasn't moved past them
+		if _, err = tx.Exec("SELECT setval(pg_get_serial_sequence('status', 'id'), (SELECT max(id) FROM status))"); err != nil {
+			return nil, err
+		}
+	}
+
+	// people, with their last editors set once everyone is in
+	edited := make([]*ExportedPerson, 0)
+	for _, p := range b.People {
+		onBoard := p.Board
+		if onBoard == "" {
+			onBoard = defaultBoard
+		}
+		if boards.find(onBoard) == nil {
+			result.Rejected = append(result.Rejected, &ImportRejection{Username: p.Username, Error: fmt.Sprintf("is on the %s board, which isn't configured", onBoard)})
+			continue
+		}
+		if !statusAllowed(existing, p.Status, onBoard) {
+			result.Rejected = append(result.Rejected, &ImportRejection{Username: p.Username, Error: fmt.Sprintf("has status %d, which the %s board doesn't have", p.Status, onBoard)})
+			continue
+		}
+		var current ExportedPerson
+		var department, notes sql.NullString
+		var status sql.NullInt64
+		var deletedAt NullTime
+		err = tx.QueryRow(s.rebind("SELECT name, department, telephone, mobile, office, title, board, status, notes, is_deleted, deleted_at, is_local FROM people WHERE username = ?"), p.Username).Scan(
+			&current.Name, &department, &current.Telephone, &current.Mobile, &current.Office, &current.Title, &current.Board, &status, &notes, &current.Deleted, &deletedAt, &current.Local)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(s.rebind("INSERT INTO people (username, name, department, telephone, mobile, office, title, board, status, notes, is_deleted, deleted_at, is_local) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+				p.Username, p.Name, p.Department, p.Telephone, p.Mobile, p.Office, p.Title, onBoard, p.Status, p.Remarks, sqlBool(p.Deleted), nullTime(p.DeletedAt), sqlBool(p.Local))
+			if err != nil {
+				return nil, err
+			}
+			result.Added = append(result.Added, p.Username)
+			edited = append(edited, p)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		current.Department = department.String
+		current.Status = int(status.Int64)
+		current.Remarks = notes.String
+		if current.Name == p.Name && current.Department == p.Department && current.Telephone == p.Telephone &&
+			current.Mobile == p.Mobile && current.Office == p.Office && current.Title == p.Title && current.Board == onBoard &&
+			current.Status == p.Status && current.Remarks == p.Remarks && current.Deleted == p.Deleted && current.Local == p.Local {
+			result.Unchanged++
+			continue
+		}
+		switch conflict {
+		case conflictFail:
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s is already on the board, and differs from the import", p.Username))
+			continue
+		case conflictSkip:
+			result.Skipped = append(result.Skipped, p.Username)
+			continue
+		}
+		_, err = tx.Exec(s.rebind("UPDATE people SET name = ?, department = ?, telephone = ?, mobile = ?, office = ?, title = ?, board = ?, status = ?, notes = ?, is_deleted = ?, deleted_at = ?, is_local = ? WHERE username = ?"),
+			p.Name, p.Department, p.Telephone, p.Mobile, p.Office, p.Title, onBoard, p.Status, p.Remarks, sqlBool(p.Deleted), nullTime(p.DeletedAt), sqlBool(p.Local), p.Username)
+		if err != nil {
+			return nil, err
+		}
+		result.Updated = append(result.Updated, p.Username)
+		edited = append(edited, p)
+	}
+	if len(result.Conflicts) > 0 {
+		return result, errImportConflict
+	}
+	for _, p := range edited {
+		editTime := nullTime(p.LastEditTime)
+		if !editTime.Valid {
+			editTime = NullTime{Time: time.Now().UTC(), Valid: true}
+		}
+		_, err = tx.Exec(s.rebind("UPDATE people SET last_editor = (SELECT id FROM people WHERE username = ?), last_edit_time = ? WHERE username = ?"),
+			p.LastEditor, editTime, p.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the sync history, leaving out syncs that are already there
+	for _, run := range b.SyncRuns {
+		var count int
+		err = tx.QueryRow(s.rebind("SELECT count(*) FROM sync_runs WHERE trigger = ? AND start_time = ?"), run.Trigger, run.StartTime.UTC()).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = tx.Exec(s.rebind("INSERT INTO sync_runs (trigger, start_time, end_time, added, updated, removed, errors, message) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+			run.Trigger, run.StartTime.UTC(), nullTime(run.EndTime), run.Added, run.Updated, run.Removed, run.Errors, run.Message)
+		if err != nil {
+			return nil, err
+		}
+		result.SyncRuns++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if result.Statuses > 0 {
+		// the cached status codes are out of date
+		s.mutex.Lock()
+		s.statusCodes = make(map[int]Status)
+		s.mutex.Unlock()
+	}
+	return result, nil
+}
+
+// a NullTime for an optional time, in UTC
+func nullTime(t *time.Time) NullTime {
+	if t == nil {
+		return NullTime{}
+	}
+	return NullTime{Time: t.UTC(), Valid: true}
+}
+
+// status.board is NULL for a status on every board
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// a status as it's described in a conflict
+func describeStatus(status Status) string {
+	if status.Board == "" {
+		return fmt.Sprintf("%q", status.Value)
+	}
+	return fmt.Sprintf("%q on the %s board", status.Value, status.Board)
+}
+
+// is_deleted and is_local are integers, for both databases
+func sqlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Write the board to a file, or to stdout for "-". This is
+// the --export command.
+func exportBoard(path string, history bool) error {
+	b, err := store.ExportBoard(history)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(b); err != nil {
+		return err
+	}
+	if path != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %d people and %d status codes to %s\n", len(b.People), len(b.Statuses), path)
+		return out.Close()
+	}
+	return nil
+}
+
+// Import the board from a file, or from stdin for "-". This
+// is the --import command.
+func importBoard(path string, conflict string) error {
+	in := os.Stdin
+	if path != "-" {
+		var err error
+		if in, err = os.Open(path); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	b, err := readExport(in)
+	if err != nil {
+		return err
+	}
+	result, err := store.ImportBoard(b, conflict)
+	if errors.Is(err, errImportConflict) {
+		for _, c := range result.Conflicts {
+			fmt.Fprintln(os.Stderr, c)
+		}
+		return errors.New("nothing was imported, because of conflicts")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %d people, updated %d, skipped %d and left %d unchanged\n",
+		len(result.Added), len(result.Updated), len(result.Skipped), result.Unchanged)
+	if len(result.Rejected) > 0 {
+		fmt.Printf("Left out %d people:\n", len(result.Rejected))
+		for _, rejected := range result.Rejected {
+			fmt.Printf("  ! %s %s\n", rejected.Username, rejected.Error)
+		}
+	}
+	if result.Statuses > 0 || result.SyncRuns > 0 {
+		fmt.Printf("Added or renamed %d status codes, and added %d syncs to the history\n", result.Statuses, result.SyncRuns)
+	}
+	return nil
+}
+
+// Download the whole board as JSON:
+//
+//	GET /api/admin/export               people and status codes
+//	GET /api/admin/export?history=true  with the LDAP sync history
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, OPTIONS, HEAD")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET", "HEAD":
+		b, err := store.ExportBoard(r.URL.Query().Get("history") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s exported the board", usernameFromContext(r.Context()))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "inoutboard-"+b.ExportedAt.UTC().Format(backupTimeFormat)+".json"))
+		if err = json.NewEncoder(w).Encode(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// Import a board exported as JSON:
+//
+//	POST /api/admin/import?conflict=update|skip|fail
+//
+// Responds with what was done, or 409 with the conflicts if
+// conflict=fail and nothing was imported.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "POST, OPTIONS")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "POST":
+		conflict, err := parseConflict(r.URL.Query().Get("conflict"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := readExport(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := store.ImportBoard(b, conflict)
+		status := http.StatusOK
+		if errors.Is(err, errImportConflict) {
+			status = http.StatusConflict
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else {
+			log.Infof("%s imported the board: %d added, %d updated, %d skipped, %d rejected", usernameFromContext(r.Context()),
+				len(result.Added), len(result.Updated), len(result.Skipped), len(result.Rejected))
+		}
+		w.WriteHeader(status)
+		if err = json.NewEncoder(w).Encode(result); err != nil {
+			log.Error(err)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Open a new, migrated database, without making it the store
+func openMigratedTestStore(tb testing.TB) *sqlStore {
+	tb.Helper()
+	s := openTestStore(tb)
+	if err := s.Migrate(); err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// Use the default board and a north board for a test
+func useTestBoards(tb testing.TB) {
+	previous := boards
+	boards = boardSettings{
+		list:   []*Board{{Name: defaultBoard}, {Name: "north"}},
+		values: map[string]string{defaultBoard: defaultBoard, "north": "north"},
+	}
+	tb.Cleanup(func() { boards = previous })
+}
+
+// Fill a database with people on both boards, with statuses,
+// a board's own status code, a removed person and a local one
+func seedExportStore(t *testing.T, s *sqlStore) {
+	t.Helper()
+	lunch, err := s.AddStatus("north", "Lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Person{
+		{Username: "amy", Name: "Amy", Department: "Sales", Telephone: "101", Board: defaultBoard, Status: Status{Code: 2}, Remarks: "back at 3"},
+		{Username: "cat", Name: "Cat", Department: "Support", Board: "north", Status: *lunch},
+		{Username: "dan", Name: "Dan", Board: defaultBoard},
+		{Username: "eve", Name: "Eve", Board: "north"},
+	} {
+		if _, err = s.AddPerson(p.Username, p.Name, p.Department, p.Telephone, "", "", "", p.Board); err != nil {
+			t.Fatal(err)
+		}
+		if p.Status.Code != 0 {
+			if err = s.SetPerson(p, "amy"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = s.RemovePerson(&Person{Username: "dan"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MarkLocal("eve"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Whether someone is in the database, removed or not
+func hasPerson(t *testing.T, s *sqlStore, username string) bool {
+	t.Helper()
+	var count int
+	if err := s.queryRow("SELECT count(*) FROM people WHERE username = ?", username).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+// Export a store, through JSON as it would be written to a file
+func exportThroughJSON(t *testing.T, s *sqlStore) *BoardExport {
+	t.Helper()
+	b, err := s.ExportBoard(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readExport(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+// the people and status codes in an export, as JSON, so
+// they can be compared
+func exportedBoard(t *testing.T, s *sqlStore) string {
+	t.Helper()
+	b := exportThroughJSON(t, s)
+	content, err := json.Marshal(struct {
+		Statuses []Status
+		People   []*ExportedPerson
+	}{b.Statuses, b.People})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	useTestBoards(t)
+	from := openMigratedTestStore(t)
+	seedExportStore(t, from)
+	b := exportThroughJSON(t, from)
+
+	to := openMigratedTestStore(t)
+	result, err := to.ImportBoard(b, conflictUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"amy", "cat", "dan", "eve"}; !reflect.DeepEqual(result.Added, want) {
+		t.Errorf("added %v, want %v", result.Added, want)
+	}
+	if len(result.Rejected) != 0 {
+		t.Errorf("rejected %+v, want nobody", result.Rejected)
+	}
+	if result.Statuses != 1 {
+		t.Errorf("imported %d status codes, want the north board's 1", result.Statuses)
+	}
+	if got, want := exportedBoard(t, to), exportedBoard(t, from); got != want {
+		t.Errorf("the imported board is\n%s\nwant\n%s", got, want)
+	}
+
+	cat, err := to.GetPerson("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cat.Board != "north" || cat.Status.Value != "Lunch" || cat.LastEditor != "Amy" {
+		t.Errorf("cat is on %q with %q, set by %q; want north, Lunch and Amy", cat.Board, cat.Status.Value, cat.LastEditor)
+	}
+	dan, err := to.GetPerson("dan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dan.IsDeleted || dan.DeletedAt == nil {
+		t.Errorf("dan is deleted %t at %v, want removed", dan.IsDeleted, dan.DeletedAt)
+	}
+	eve, err := to.GetPerson("eve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eve.IsLocal {
+		t.Errorf("eve isn't local after the import")
+	}
+}
+
+func TestImportTwiceChangesNothing(t *testing.T) {
+	useTestBoards(t)
+	from := openMigratedTestStore(t)
+	seedExportStore(t, from)
+	b := exportThroughJSON(t, from)
+
+	to := openMigratedTestStore(t)
+	if _, err := to.ImportBoard(b, conflictFail); err != nil {
+		t.Fatal(err)
+	}
+	before := exportedBoard(t, to)
+	for _, conflict := range []string{conflictUpdate, conflictSkip, conflictFail} {
+		result, err := to.ImportBoard(b, conflict)
+		if err != nil {
+			t.Fatalf("importing again with %s: %s", conflict, err)
+		}
+		if len(result.Added)+len(result.Updated)+len(result.Skipped) != 0 || result.Statuses != 0 || result.Unchanged != len(b.People) {
+			t.Errorf("importing again with %s = %+v, want everyone unchanged", conflict, result)
+		}
+		if after := exportedBoard(t, to); after != before {
+			t.Errorf("importing again with %s changed the board to\n%s\nfrom\n%s", conflict, after, before)
+		}
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	useTestBoards(t)
+	tests := []struct {
+		conflict string
+		wantErr  error
+		added    []string
+		updated  []string
+		skipped  []string
+		// amy's name and whether fay is there afterwards
+		name string
+		fay  bool
+	}{
+		{conflictUpdate, nil, []string{"fay"}, []string{"amy"}, []string{}, "Amy", true},
+		{conflictSkip, nil, []string{"fay"}, []string{}, []string{"amy"}, "Amy Jones", true},
+		{conflictFail, errImportConflict, []string{"fay"}, []string{}, []string{}, "Amy Jones", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			s := openMigratedTestStore(t)
+			seedExportStore(t, s)
+			b := exportThroughJSON(t, s)
+			b.People = append(b.People, &ExportedPerson{Username: "fay", Name: "Fay"})
+			if err := s.SetPersonDetails(&Person{Username: "amy", Name: "Amy Jones", Department: "Sales", Telephone: "101"}); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := s.ImportBoard(b, tt.conflict)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ImportBoard error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(result.Conflicts) != 1 {
+					t.Errorf("conflicts = %v, want amy's", result.Conflicts)
+				}
+			} else if !reflect.DeepEqual(result.Added, tt.added) || !reflect.DeepEqual(result.Updated, tt.updated) || !reflect.DeepEqual(result.Skipped, tt.skipped) {
+				t.Errorf("added %v, updated %v, skipped %v; want %v, %v, %v",
+					result.Added, result.Updated, result.Skipped, tt.added, tt.updated, tt.skipped)
+			}
+
+			amy, err := s.GetPerson("amy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if amy.Name != tt.name {
+				t.Errorf("amy is called %q, want %q", amy.Name, tt.name)
+			}
+			if fay := hasPerson(t, s, "fay"); fay != tt.fay {
+				t.Errorf("fay was imported %t, want %t", fay, tt.fay)
+			}
+		})
+	}
+}
+
+func TestImportRejectsBoardsAndStatuses(t *testing.T) {
+	useTestBoards(t)
+	tests := []struct {
+		name   string
+		person *ExportedPerson
+		reject bool
+	}{
+		{"the default board", &ExportedPerson{Username: "fay", Name: "Fay", Status: 1}, false},
+		{"another board", &ExportedPerson{Username: "fay", Name: "Fay", Board: "north", Status: 1}, false},
+		{"no status", &ExportedPerson{Username: "fay", Name: "Fay", Board: "north"}, false},
+		{"the board's own status", &ExportedPerson{Username: "fay", Name: "Fay", Board: "north", Status: 4}, false},
+		{"a board that isn't configured", &ExportedPerson{Username: "fay", Name: "Fay", Board: "south", Status: 1}, true},
+		{"another board's status", &ExportedPerson{Username: "fay", Name: "Fay", Status: 4}, true},
+		{"a status that doesn't exist", &ExportedPerson{Username: "fay", Name: "Fay", Status: 99}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openMigratedTestStore(t)
+			b := &BoardExport{
+				Format:   exportFormat,
+				Version:  exportVersion,
+				Statuses: []Status{{Code: 4, Value: "Lunch", Board: "north"}},
+				People:   []*ExportedPerson{{Username: "amy", Name: "Amy"}, tt.person},
+			}
+			result, err := s.ImportBoard(b, conflictUpdate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(result.Rejected) == 1 && result.Rejected[0].Username == "fay"; got != tt.reject {
+				t.Fatalf("rejected %+v, want fay rejected %t", result.Rejected, tt.reject)
+			}
+			if fay := hasPerson(t, s, "fay"); fay == tt.reject {
+				t.Errorf("fay was imported %t, want %t", fay, !tt.reject)
+			}
+			if !hasPerson(t, s, "amy") {
+				t.Errorf("amy wasn't imported alongside fay")
+			}
+		})
+	}
+}
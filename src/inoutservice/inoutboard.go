@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,6 +33,8 @@ const (
 type Status struct {
 	Code  int
 	Value string
+	// the board the status is for, or empty if it's on every board
+	Board string `json:",omitempty"`
 }
 
 // A person record
@@ -46,9 +49,17 @@ type Person struct {
 	Telephone    string
 	Office       string
 	Title        string
+	Board        string
 	LastEditor   string
 	LastEditTime time.Time
 	IsDeleted    bool
+	// added by hand, eg: from a CSV file, rather than from
+	// LDAP. Syncs don't remove them for not being in LDAP.
+	IsLocal bool
+	// when the person was removed from the board
+	DeletedAt *time.Time `json:",omitempty"`
+	// LDAP groups the person belongs to
+	Groups []string `json:"-"`
 }
 
 // cached Config
@@ -63,12 +74,16 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		var user *Person
 		var err error
+		if !hasScope(r.Context(), ScopePeopleRead) {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
 		log.Printf(r.URL.Path)
 		if r.URL.Path[len("user/"):] != "" {
-			user, err = GetPerson(r.URL.Path[len("user/"):])
+			user, err = store.GetPerson(r.URL.Path[len("user/"):])
 		} else {
 			log.Printf("user from context: %s", username)
-			user, err = GetPerson(username)
+			user, err = store.GetPerson(username)
 		}
 		if err != nil {
 			http.NotFound(w, r)
@@ -85,10 +100,35 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !hasScope(r.Context(), ScopeStatusWrite) &&
+			!(hasScope(r.Context(), ScopeStatusWriteSelf) && person.Username == username) {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		// the status has to be one the person's board has
+		codes, err := store.StatusCodes()
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		err = SetPerson(person, username)
-		updated, err := GetPerson(username)
+		onBoard, err := board.BoardOf(person.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !statusAllowed(codes, person.Status.Code, onBoard) {
+			http.Error(w, fmt.Sprintf("the %s board doesn't have the status %d", onBoard, person.Status.Code), http.StatusBadRequest)
+			return
+		}
+		if err = store.SetPerson(person, username); err != nil {
+			log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updated, err := store.GetPerson(username)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		} else {
@@ -103,46 +143,54 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// get a list of people from the database
+// get a list of the people on the user's board, from its snapshot
 func peopleHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Methods", "GET, OPTIONS, HEAD")
 	switch r.Method {
 	case "OPTIONS":
 		break
 
-	case "GET":
-		peopleInterface := make([]interface{}, 0)
-		people, err := GetUsers()
+	case "GET", "HEAD":
+		if !hasScope(r.Context(), ScopePeopleRead) {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		name, err := board.BoardOf(usernameFromContext(r.Context()))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		for _, person := range people {
-			log.Debugf("Person: %s", person.Name)
-			peopleInterface = append(peopleInterface, person)
-		}
-		log.Debugf("GetUsers returned %d people", len(peopleInterface))
-
-		if err := json.NewEncoder(w).Encode(peopleInterface); err != nil {
+		snapshot, err := board.Snapshot(name)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		log.Debugf("Serving board snapshot %d of %s, with %d people", snapshot.version, name, len(snapshot.people))
+		snapshot.serve(w, r)
 	default:
 		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
 	return
 }
 
-// Get a list of available status codes from the database
+// Get a list of the status codes people on the user's
+// board can have
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	statusInterface := make([]interface{}, 0)
-	statuses, err := StatusCodes()
+	if !hasScope(r.Context(), ScopePeopleRead) {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	name, err := board.BoardOf(usernameFromContext(r.Context()))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	for _, status := range statuses {
-		statusInterface = append(statusInterface, status)
+	statuses, err := boardStatusCodes(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if err := json.NewEncoder(w).Encode(statusInterface); err != nil {
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	return
@@ -199,12 +247,18 @@ func getEnvArgs() Config {
 	}
 	log.Printf("Static files: %s", cfg.Files.StaticFilesPath)
 
-	log.Printf("config ldapServer: %s", cfg.Auth.LdapServer)
-	if cfg.Files.DbPath != "" {
+	log.Printf("config ldapServer: %s", strings.Join(cfg.Auth.LdapServer, ", "))
+	for name, d := range cfg.Directory {
+		log.Printf("config ldapServer for %s: %s", name, strings.Join(d.LdapServer, ", "))
+	}
+	if cfg.Database.Driver == "" || cfg.Database.Driver == dialectSqlite {
 		log.Printf("using db: %s", cfg.Files.DbPath)
-		createDb(cfg.Files.DbPath)
 	} else {
-		log.Fatal("DbPath must be defined in the [Files] section of the config file.")
+		log.Printf("using %s db", cfg.Database.Driver)
+	}
+	store, err = openStore(&cfg)
+	if err != nil {
+		log.Fatalf("Could not open the database: %s", err)
 	}
 
 	if cfg.Files.TLSCert == "" {
@@ -259,40 +313,268 @@ func main() {
 		port = cfg.Net.Port
 	}
 
-	authOptions := AuthorizationOptions{
-		realm:          cfg.Auth.Realm,
-		ldapServer:     cfg.Auth.LdapServer,
-		port:           cfg.Auth.LdapPort,
-		username:       cfg.Auth.Username,
-		password:       cfg.Auth.BindPassword,
-		ldapSearchBase: cfg.Auth.LdapSearchBase,
+	var err error
+	boards, err = boardsFromConfig(&cfg)
+	if err != nil {
+		log.Fatalf("Bad board configuration: %s", err)
+	}
+	options, err := newAuthorizationOptions(&cfg)
+	if err != nil {
+		log.Fatalf("Bad LDAP configuration: %s", err)
 	}
+	// set once, before anything reads it
+	authOptions = &options
+
+	syncSafety = syncLimitsFromConfig(&cfg)
+	fullSyncInterval = fullSyncIntervalFromConfig(&cfg)
+	backups = backupScheduleFromConfig(&cfg)
+	retention = retentionFromConfig(&cfg)
 
 	// parse command line args
 	// if the --update-users argument is found
 	// update the users from LDAP and exit
 	var verbose bool
 	var update bool
+	var dryRun bool
+	var asJSON bool
+	var mode syncMode
+	var migrate bool
+	var migrateStatus bool
+	var backupPath string
+	var restorePath string
+	var replicaPath string
+	var exportPath string
+	var importPath string
+	var history bool
+	conflict := conflictUpdate
+	var csvPath string
+	var csvColumns []string
+	var csvStatuses []string
+	restoreTime := time.Now()
 
 	if len(os.Args[1:]) > 0 { // found command-line args
-		for _, p := range os.Args[1:] {
-			switch p {
+		for i := 1; i < len(os.Args); i++ {
+			switch os.Args[i] {
 			case "--update-users":
 				update = true
 
+			case "--migrate":
+				migrate = true
+
+			case "--migrate-status":
+				migrateStatus = true
+
+			case "--backup", "--restore":
+				if i+1 == len(os.Args) {
+					fmt.Fprintf(os.Stderr, "%s needs the path of a backup file\n", os.Args[i])
+					os.Exit(2)
+				}
+				if os.Args[i] == "--backup" {
+					backupPath = os.Args[i+1]
+				} else {
+					restorePath = os.Args[i+1]
+				}
+				i++
+
+			case "--restore-replica":
+				if i+1 == len(os.Args) {
+					fmt.Fprintln(os.Stderr, "--restore-replica needs the path to write the database to")
+					os.Exit(2)
+				}
+				replicaPath = os.Args[i+1]
+				i++
+
+			case "--at":
+				if i+1 == len(os.Args) {
+					fmt.Fprintln(os.Stderr, "--at needs a time, eg: 2006-01-02T15:04:05Z")
+					os.Exit(2)
+				}
+				if restoreTime, err = time.Parse(time.RFC3339, os.Args[i+1]); err != nil {
+					fmt.Fprintf(os.Stderr, "Bad time for --at: %s\n", err)
+					os.Exit(2)
+				}
+				i++
+
+			case "--export", "--import":
+				if i+1 == len(os.Args) {
+					fmt.Fprintf(os.Stderr, "%s needs the path of a JSON file, or - for the console\n", os.Args[i])
+					os.Exit(2)
+				}
+				if os.Args[i] == "--export" {
+					exportPath = os.Args[i+1]
+				} else {
+					importPath = os.Args[i+1]
+				}
+				i++
+
+			case "--import-csv":
+				if i+1 == len(os.Args) {
+					fmt.Fprintln(os.Stderr, "--import-csv needs the path of a CSV file")
+					os.Exit(2)
+				}
+				csvPath = os.Args[i+1]
+				i++
+
+			case "--csv-column", "--csv-status":
+				if i+1 == len(os.Args) {
+					fmt.Fprintf(os.Stderr, "%s needs a mapping, eg: Username=Login or Away=Out\n", os.Args[i])
+					os.Exit(2)
+				}
+				if os.Args[i] == "--csv-column" {
+					csvColumns = append(csvColumns, os.Args[i+1])
+				} else {
+					csvStatuses = append(csvStatuses, os.Args[i+1])
+				}
+				i++
+
+			case "--history":
+				history = true
+
+			case "--on-conflict":
+				if i+1 == len(os.Args) {
+					fmt.Fprintln(os.Stderr, "--on-conflict needs update, skip or fail")
+					os.Exit(2)
+				}
+				if conflict, err = parseConflict(os.Args[i+1]); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(2)
+				}
+				i++
+
+			case "--dry-run":
+				dryRun = true
+
+			case "--json":
+				asJSON = true
+
+			case "--force":
+				mode.force = true
+
+			case "--full":
+				mode.full = true
+
 			case "--verbose":
 				verbose = true
 			}
 		}
-		if update { // run ldap update
-			if !verbose {
-				log.SetOutput(ioutil.Discard)
+		if restorePath != "" { // replace the database with a backup and exit
+			store.Close()
+			if cfg.Database.Driver != "" && cfg.Database.Driver != dialectSqlite {
+				fmt.Fprintln(os.Stderr, errBackupUnsupported)
+				os.Exit(1)
+			}
+			if err := restoreBackup(cfg.Files.DbPath, restorePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Restore failed: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if replicaPath != "" { // rebuild the database from the replica and exit
+			if cfg.Replication.Destination == "" {
+				fmt.Fprintln(os.Stderr, "No Destination is set in the [Replication] section of the config file")
+				os.Exit(1)
+			}
+			if err := restoreReplica(cfg.Replication.Destination, replicaPath, restoreTime); err != nil {
+				fmt.Fprintf(os.Stderr, "Restore failed: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Stop the service and use --restore %s to put it in place\n", replicaPath)
+			return
+		}
+		if backupPath != "" { // back up the database and exit
+			if err := store.Backup(backupPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Backup failed: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Backed up the database to %s\n", backupPath)
+			return
+		}
+		if migrateStatus { // show the schema migrations and exit
+			if err := store.MigrationStatus(os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not get the migration status: %s\n", err)
+				os.Exit(1)
 			}
-			UpdateLdap(authOptions)
 			return
 		}
 	}
 
+	if err = store.Migrate(); err != nil {
+		log.Fatalf("Could not migrate the database: %s", err)
+	}
+	if migrate { // only apply the migrations
+		fmt.Println("The database is up to date")
+		return
+	}
+	if exportPath != "" { // write the board to a file and exit
+		if err := exportBoard(exportPath, history); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if importPath != "" { // read the board from a file and exit
+		if err := importBoard(importPath, conflict); err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if csvPath != "" { // import people from a spreadsheet and exit
+		mapping, err := parseCSVMapping(csvColumns, csvStatuses)
+		if err == nil {
+			err = importCSV(csvPath, mapping, dryRun, asJSON, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "CSV import failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if update { // run ldap update
+		if !verbose {
+			log.SetOutput(ioutil.Discard)
+		}
+		if dryRun { // only show what would change
+			if err := DryRunLdap(options, mode.full, asJSON, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "LDAP update failed: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if err := UpdateLdap(options, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "LDAP update failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the board is served from a snapshot in memory, which
+	// everything from here on changes people through
+	board = newBoardCache(store)
+	store = board
+
+	loginLimiter = newLoginThrottle(&cfg)
+
+	if cfg.Sync.IntervalMinutes > 0 {
+		go scheduleSync(options, time.Duration(cfg.Sync.IntervalMinutes)*time.Minute)
+	}
+	if backups.interval > 0 {
+		if backups.dir == "" {
+			log.Fatal("The [Backup] section needs a Directory for scheduled backups")
+		}
+		go scheduleBackups(backups)
+	}
+	if cfg.Replication.Destination != "" {
+		r, err := newReplicator(&cfg, board.Store)
+		if err != nil {
+			log.Fatalf("Could not start replication: %s", err)
+		}
+		go r.run()
+	}
+
+	go scheduleJanitor(retention.interval)
+
 	// configure the server
 	logger := log.New()
 	logger.SetLevel(log.StandardLogger().Level)
@@ -304,10 +586,22 @@ func main() {
 		Logger: logger,
 	}
 
-	http.Handle("/api/user/", l.Handler(AuthorizationMiddleware(authOptions, AddHeaders(http.StripPrefix("/api/", http.HandlerFunc(handler)))), "user"))
-	http.Handle("/api/people/", l.Handler(AuthorizationMiddleware(authOptions, AddHeaders(http.HandlerFunc(peopleHandler))), "people"))
-	http.Handle("/api/statuscodes", l.Handler(AuthorizationMiddleware(authOptions, AddHeaders(http.HandlerFunc(statusHandler))), "statuses"))
-	//http.Handle("/api/people", l.Handler(AuthorizationMiddleware(authOptions, AddHeaders(http.HandlerFunc(peopleHandler))), "people"))
+	http.Handle("/api/user/", l.Handler(AuthorizationMiddleware(AddHeaders(http.StripPrefix("/api/", http.HandlerFunc(handler)))), "user"))
+	http.Handle("/api/people/", l.Handler(AuthorizationMiddleware(AddHeaders(http.HandlerFunc(peopleHandler))), "people"))
+	http.Handle("/api/boards/", l.Handler(AuthorizationMiddleware(AddHeaders(http.HandlerFunc(boardsHandler))), "boards"))
+	http.Handle("/api/statuscodes", l.Handler(AuthorizationMiddleware(AddHeaders(http.HandlerFunc(statusHandler))), "statuses"))
+	tokens := l.Handler(AuthorizationMiddleware(AddHeaders(http.HandlerFunc(tokensHandler))), "tokens")
+	http.Handle("/api/tokens", tokens)
+	http.Handle("/api/tokens/", tokens)
+	http.Handle("/api/admin/sync/", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(syncHandler)))), "sync"))
+	http.Handle("/api/admin/sync/plan", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(syncPlanHandler)))), "syncplan"))
+	http.Handle("/api/admin/backups/", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(backupsHandler)))), "backups"))
+	http.Handle("/api/admin/export", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(exportHandler)))), "export"))
+	http.Handle("/api/admin/import", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(importHandler)))), "import"))
+	http.Handle("/api/admin/import/csv", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(importCSVHandler)))), "importcsv"))
+	http.Handle("/api/admin/people/deleted/", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(deletedPeopleHandler)))), "deletedpeople"))
+	http.Handle("/api/admin/retention", l.Handler(AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(retentionHandler)))), "retention"))
+	//http.Handle("/api/people", l.Handler(AuthorizationMiddleware(AddHeaders(http.HandlerFunc(peopleHandler))), "people"))
 	fs := http.FileServer(http.Dir(cfg.Files.StaticFilesPath))
 	http.Handle("/", AddHTMLHeaders(fs))
 	log.Printf("Starting service on port %d", port)
@@ -330,9 +624,9 @@ func main() {
 
 			client := &http.Client{Transport: tr, Timeout: time.Second * 2}
 			res, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
-			defer res.Body.Close()
 
 			if err == nil {
+				res.Body.Close()
 				daemon.SdNotify(false, "WATCHDOG=1")
 			}
 			time.Sleep(interval / 3)
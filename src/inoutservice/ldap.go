@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of connecting to the LDAP server
+const (
+	// LDAP over TLS, usually on port 636
+	LdapModeLDAPS = "ldaps"
+	// plain LDAP upgraded with the StartTLS extended operation
+	LdapModeStartTLS = "starttls"
+	// unencrypted LDAP. Only for testing against a stand-in server.
+	LdapModePlain = "plain"
+)
+
+// Build the TLS configuration used to talk to the LDAP server
+// from a directory's section of the config file. Certificates
+// are verified unless LdapInsecureSkipVerify is set.
+func newLdapTLSConfig(cfg *DirectoryConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.LdapServerName,
+		InsecureSkipVerify: cfg.LdapInsecureSkipVerify,
+	}
+	if cfg.LdapCACert != "" {
+		pem, err := ioutil.ReadFile(cfg.LdapCACert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read LDAP CA bundle %s: %s", cfg.LdapCACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in LDAP CA bundle %s", cfg.LdapCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.LdapClientCert != "" || cfg.LdapClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.LdapClientCert, cfg.LdapClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load LDAP client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.InsecureSkipVerify {
+		log.Warn("LDAP server certificate verification is disabled")
+	}
+	return tlsConfig, nil
+}
+
+// Work out the LDAP connection mode and port from the config file
+func ldapModeAndPort(cfg *DirectoryConfig) (string, int, error) {
+	mode := strings.ToLower(cfg.LdapMode)
+	if mode == "" {
+		mode = LdapModeStartTLS
+	}
+	port := cfg.LdapPort
+	switch mode {
+	case LdapModeLDAPS:
+		if port == 0 {
+			port = 636
+		}
+	case LdapModeStartTLS, LdapModePlain:
+		if port == 0 {
+			port = 389
+		}
+	default:
+		return "", 0, fmt.Errorf("unknown LdapMode %s (expected ldaps, starttls or plain)", cfg.LdapMode)
+	}
+	if mode == LdapModePlain {
+		log.Warn("LDAP connections are not encrypted (LdapMode = plain)")
+	}
+	return mode, port, nil
+}
+
+// Returned (wrapped) when none of the LDAP servers could
+// be reached, or they were too busy to answer
+var ErrLdapUnavailable = errors.New("LDAP server unavailable")
+
+// Default connection settings, used when the config file
+// doesn't say otherwise
+const (
+	defaultLdapTimeout  = 10 * time.Second
+	defaultLdapRetries  = 2
+	defaultLdapPoolSize = 4
+	// idle connections are checked before reuse after this long
+	ldapHealthCheckAfter = 30 * time.Second
+	// and closed after this long, since servers drop idle clients
+	ldapMaxIdleTime = 5 * time.Minute
+)
+
+// A pool of connections to the LDAP servers, bound as the
+// service account. Servers are tried in order, starting with
+// the last one that worked.
+type ldapPool struct {
+	servers   []string
+	port      int
+	mode      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	retries   int
+	bindName  string
+	password  string
+	maxIdle   int
+
+	mutex   sync.Mutex
+	idle    []*pooledLdapConn
+	current int
+}
+
+// an idle connection in the pool
+type pooledLdapConn struct {
+	conn     *ldap.Conn
+	lastUsed time.Time
+}
+
+// Create a connection pool for a directory
+func newLdapPool(d *directory, timeout time.Duration, retries int, size int) *ldapPool {
+	if timeout <= 0 {
+		timeout = defaultLdapTimeout
+	}
+	if retries <= 0 {
+		retries = defaultLdapRetries
+	}
+	if size <= 0 {
+		size = defaultLdapPoolSize
+	}
+	return &ldapPool{
+		servers:   d.ldapServers,
+		port:      d.port,
+		mode:      d.mode,
+		tlsConfig: d.tlsConfig,
+		timeout:   timeout,
+		retries:   retries,
+		bindName:  serviceBindName(d),
+		password:  d.password,
+		maxIdle:   size,
+	}
+}
+
+// Run a function with a bound connection from the pool. If
+// the server can't be reached or the connection has gone bad,
+// the connection is thrown away and the function is retried
+// on a new one, possibly on another server.
+func (p *ldapPool) do(fn func(conn *ldap.Conn) error) error {
+	var err error
+	for attempt := 0; attempt <= p.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+		}
+		var conn *ldap.Conn
+		conn, err = p.get()
+		if err != nil {
+			continue
+		}
+		err = fn(conn)
+		if err == nil {
+			p.put(conn)
+			return nil
+		}
+		conn.Close()
+		if !isLdapUnavailable(err) {
+			return err
+		}
+		log.Warnf("LDAP request failed, retrying: %s", err)
+	}
+	return fmt.Errorf("%w: %s", ErrLdapUnavailable, err)
+}
+
+// Get a connection from the pool, or open a new one
+func (p *ldapPool) get() (*ldap.Conn, error) {
+	for {
+		p.mutex.Lock()
+		if len(p.idle) == 0 {
+			p.mutex.Unlock()
+			break
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mutex.Unlock()
+
+		idleFor := time.Since(pc.lastUsed)
+		if idleFor > ldapMaxIdleTime {
+			pc.conn.Close()
+			continue
+		}
+		if idleFor > ldapHealthCheckAfter && !p.healthy(pc.conn) {
+			log.Debug("Discarding unhealthy LDAP connection")
+			pc.conn.Close()
+			continue
+		}
+		return pc.conn, nil
+	}
+	return p.dial()
+}
+
+// Return a connection to the pool
+func (p *ldapPool) put(conn *ldap.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, &pooledLdapConn{conn: conn, lastUsed: time.Now()})
+}
+
+// Check a connection with a cheap read of the root DSE
+func (p *ldapPool) healthy(conn *ldap.Conn) bool {
+	req := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, int(p.timeout/time.Second), false,
+		"(objectClass=*)", []string{"supportedLDAPVersion"}, nil)
+	_, err := conn.Search(req)
+	return err == nil
+}
+
+// Open and bind a new connection, trying each server in turn
+func (p *ldapPool) dial() (*ldap.Conn, error) {
+	if len(p.servers) == 0 {
+		return nil, errors.New("no LDAP servers are configured")
+	}
+	p.mutex.Lock()
+	start := p.current
+	p.mutex.Unlock()
+
+	var err error
+	for i := 0; i < len(p.servers); i++ {
+		n := (start + i) % len(p.servers)
+		var conn *ldap.Conn
+		conn, err = p.dialServer(p.servers[n])
+		if err != nil {
+			continue
+		}
+		if err = conn.Bind(p.bindName, p.password); err != nil {
+			log.Errorf("Could not bind to LDAP server %s as %s: %s", p.servers[n], p.bindName, err)
+			conn.Close()
+			if !isLdapUnavailable(err) {
+				return nil, err
+			}
+			continue
+		}
+		if n != start {
+			log.Warnf("Failed over to LDAP server %s", p.servers[n])
+			p.mutex.Lock()
+			p.current = n
+			p.mutex.Unlock()
+		}
+		return conn, nil
+	}
+	return nil, err
+}
+
+// Open a connection to one LDAP server using the configured
+// mode. The connection is not bound.
+func (p *ldapPool) dialServer(server string) (*ldap.Conn, error) {
+	host, port := server, strconv.Itoa(p.port)
+	if h, hp, err := net.SplitHostPort(server); err == nil {
+		host, port = h, hp
+	}
+	hostaddr := net.JoinHostPort(host, port)
+
+	tlsConfig := p.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: p.timeout}
+
+	var conn *ldap.Conn
+	if p.mode == LdapModeLDAPS {
+		c, err := tls.DialWithDialer(dialer, "tcp", hostaddr, tlsConfig)
+		if err != nil {
+			log.Errorf("Could not connect to LDAP server %s using LDAPS: %s", hostaddr, describeTLSError(err))
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		conn = ldap.NewConn(c, true)
+		conn.Start()
+	} else {
+		c, err := dialer.Dial("tcp", hostaddr)
+		if err != nil {
+			log.Errorf("Could not connect to LDAP server %s: %s", hostaddr, err)
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		conn = ldap.NewConn(c, false)
+		conn.Start()
+		if p.mode == LdapModeStartTLS {
+			if err = conn.StartTLS(tlsConfig); err != nil {
+				log.Errorf("StartTLS with LDAP server %s failed: %s", hostaddr, describeTLSError(err))
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	conn.SetTimeout(p.timeout)
+	return conn, nil
+}
+
+// Whether an error means the server couldn't be used, rather
+// than that it refused the request. Timeouts and closed
+// connections are not ldap.Errors at all.
+func isLdapUnavailable(err error) bool {
+	if errors.Is(err, ErrLdapUnavailable) {
+		return true
+	}
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok {
+		return true
+	}
+	switch ldapErr.ResultCode {
+	case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable:
+		return true
+	}
+	return false
+}
+
+// Add a hint about what to check to TLS errors, which
+// are usually configuration problems
+func describeTLSError(err error) string {
+	msg := err.Error()
+	if strings.Contains(msg, "certificate") || strings.Contains(msg, "x509") {
+		return msg + " (check LdapCACert and LdapServerName in the [Auth] section)"
+	}
+	return msg
+}
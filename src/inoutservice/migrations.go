@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schema migrations for each kind of database, named like
+// 0002_add_something.sql. They are applied in order of their
+// numbers, and must not be changed once released; add a new
+// one instead, for every kind of database.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// A numbered change to the database schema
+type migration struct {
+	Version int
+	Name    string
+	sql     string
+}
+
+// Record of a migration that has been applied
+type appliedMigration struct {
+	Version     int
+	Name        string
+	AppliedTime time.Time
+}
+
+// Load the embedded migrations for a kind of database, in order
+func loadMigrations(dialect string) ([]*migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]*migration, 0, len(entries))
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		number, title, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s should be named like 0001_name.sql", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same number", other, entry.Name())
+		}
+		seen[version] = entry.Name()
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, &migration{Version: version, Name: title, sql: string(content)})
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("there are no migrations for %s", dialect)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Get the migrations that have been applied, by version. A
+// database made before there were migrations has a schema but
+// no schema_version, and is adopted at version 1 if adopt is
+// set; otherwise legacy is returned true and nothing changes.
+// Only SQLite databases are that old.
+func (s *sqlStore) appliedMigrations(adopt bool) (applied map[int]*appliedMigration, legacy bool, err error) {
+	applied = make(map[int]*appliedMigration)
+	exists, err := s.tableExists("schema_version")
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		rows, err := s.query("SELECT version, name, applied_time FROM schema_version")
+		if err != nil {
+			return nil, false, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var m appliedMigration
+			var appliedTime NullTime
+			if err = rows.Scan(&m.Version, &m.Name, &appliedTime); err != nil {
+				return nil, false, err
+			}
+			m.AppliedTime = appliedTime.Time
+			applied[m.Version] = &m
+		}
+		if err = rows.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(applied) > 0 {
+		return applied, false, nil
+	}
+
+	// an empty schema_version with a schema is left from
+	// an adoption that didn't finish
+	if s.dialect == dialectSqlite {
+		if legacy, err = s.tableExists("people"); err != nil {
+			return nil, false, err
+		}
+	}
+	if !adopt || (exists && !legacy) {
+		return applied, legacy, nil
+	}
+	if legacy {
+		log.Warn("Adopting an existing database as schema version 1")
+	}
+	if err = s.adoptLegacyDb(exists, legacy); err != nil {
+		return nil, false, err
+	}
+	if legacy {
+		applied[1] = &appliedMigration{Version: 1, Name: "initial", AppliedTime: time.Now()}
+	}
+	return applied, false, nil
+}
+
+// Create the schema_version table, if it doesn't exist, and
+// for a database from before migrations add what it's
+// missing from version 1 and record it, all in one
+// transaction so that a failure leaves it as it was
+func (s *sqlStore) adoptLegacyDb(exists bool, legacy bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !exists {
+		if _, err = tx.Exec("CREATE TABLE schema_version (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_time TIMESTAMP NOT NULL)"); err != nil {
+			return err
+		}
+	}
+	if legacy {
+		if err = upgradeLegacyDb(tx); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(s.rebind("INSERT INTO schema_version (version, name, applied_time) VALUES (1, 'initial', ?)"), time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Apply any migrations the database is missing, each in a
+// transaction of its own. A database with migrations this
+// program doesn't know about is left alone.
+func (s *sqlStore) Migrate() error {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	applied, _, err := s.appliedMigrations(true)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].Version
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("the database is at schema version %d, but this program only knows up to %d", version, latest)
+		}
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Warnf("Applying migration %d (%s)", m.Version, m.Name)
+		if err = s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// the migration that started enforcing foreign keys in SQLite
+const foreignKeysVersion = 3
+
+// Apply one migration and record it, or nothing if it fails.
+// SQLite migrations run with foreign keys off, as SQLite
+// advises for rebuilding tables, and from when they were
+// enforced are checked for rows that break them before they're
+// committed.
+func (s *sqlStore) applyMigration(m *migration) error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.dialect == dialectSqlite {
+		if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(m.sql); err != nil {
+		return err
+	}
+	if s.dialect == dialectSqlite && m.Version >= foreignKeysVersion {
+		var table string
+		var rowid sql.NullInt64
+		var parent string
+		var fkid int
+		err = tx.QueryRow("PRAGMA foreign_key_check").Scan(&table, &rowid, &parent, &fkid)
+		if err == nil {
+			return fmt.Errorf("a row in %s refers to a missing row in %s", table, parent)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if _, err = tx.Exec(s.rebind("INSERT INTO schema_version (version, name, applied_time) VALUES (?, ?, ?)"), m.Version, m.Name, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Show which migrations have been applied and which are
+// pending, without changing the database. This is the
+// --migrate-status command.
+func (s *sqlStore) MigrationStatus(out io.Writer) error {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	applied, legacy, err := s.appliedMigrations(false)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		fmt.Fprintf(out, "The database is from before migrations, and not yet adopted; migrating adopts it at version 1\n")
+	}
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.Version] = true
+		if a, ok := applied[m.Version]; ok {
+			fmt.Fprintf(out, "%04d %-30s applied %s\n", m.Version, m.Name, a.AppliedTime.Local().Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(out, "%04d %-30s pending\n", m.Version, m.Name)
+		}
+	}
+	for version, a := range applied {
+		if !known[version] {
+			fmt.Fprintf(out, "%04d %-30s applied %s, but unknown to this program\n", version, a.Name, a.AppliedTime.Local().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+-- The same schema as the first SQLite migration. people.status
+-- has no foreign key, since new people are given status 0,
+-- which isn't one of the status codes.
+CREATE TABLE status (id SERIAL PRIMARY KEY, value TEXT);
+INSERT INTO status (value) VALUES ('In');
+INSERT INTO status (value) VALUES ('Out');
+INSERT INTO status (value) VALUES ('In Field');
+
+CREATE TABLE people (id SERIAL PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT NULL, mobile TEXT NOT NULL DEFAULT '', telephone TEXT NOT NULL DEFAULT '', office TEXT NOT NULL DEFAULT '', title TEXT NOT NULL DEFAULT '', status INTEGER NOT NULL DEFAULT 0, notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP, is_deleted INTEGER NOT NULL DEFAULT 0, deleted_at TIMESTAMPTZ NULL);
+
+CREATE TABLE sessions (id TEXT PRIMARY KEY, person_id INTEGER REFERENCES people(id), create_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP, roles TEXT NOT NULL DEFAULT '');
+
+CREATE TABLE api_tokens (id SERIAL PRIMARY KEY, person_id INTEGER REFERENCES people(id), name TEXT NOT NULL DEFAULT '', token_hash TEXT UNIQUE NOT NULL, scopes TEXT NOT NULL DEFAULT '', create_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP, expire_time TIMESTAMPTZ NULL, last_used TIMESTAMPTZ NULL);
+
+CREATE TABLE login_attempts (kind TEXT NOT NULL, key TEXT NOT NULL, failures INTEGER NOT NULL DEFAULT 0, last_failure TIMESTAMPTZ NULL, locked_until TIMESTAMPTZ NULL, PRIMARY KEY (kind, key));
+
+CREATE TABLE sync_runs (id SERIAL PRIMARY KEY, trigger TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NULL, added INTEGER NOT NULL DEFAULT 0, updated INTEGER NOT NULL DEFAULT 0, removed INTEGER NOT NULL DEFAULT 0, errors INTEGER NOT NULL DEFAULT 0, message TEXT NOT NULL DEFAULT '');
+
+CREATE TABLE sync_cursors (directory TEXT PRIMARY KEY, attribute TEXT NOT NULL, value TEXT NOT NULL, server TEXT NOT NULL DEFAULT '', full_sync_time TIMESTAMPTZ NOT NULL);
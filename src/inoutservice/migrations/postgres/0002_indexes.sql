@@ -0,0 +1,5 @@
+-- Indexes for looking up a person's sessions and tokens,
+-- and the people on the board
+CREATE INDEX sessions_person_id ON sessions (person_id);
+CREATE INDEX api_tokens_person_id ON api_tokens (person_id);
+CREATE INDEX people_is_deleted ON people (is_deleted, department, name);
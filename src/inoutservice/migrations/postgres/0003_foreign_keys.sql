@@ -0,0 +1,5 @@
+-- Foreign keys are enforced in SQLite from this version on.
+-- PostgreSQL always enforced them, and people.status never had
+-- one, so there should be nothing to tidy up here.
+DELETE FROM sessions WHERE person_id NOT IN (SELECT id FROM people);
+DELETE FROM api_tokens WHERE person_id NOT IN (SELECT id FROM people);
@@ -0,0 +1,3 @@
+-- People added by hand, eg: from a CSV file, rather than from
+-- LDAP. Syncs don't remove them for not being in LDAP.
+ALTER TABLE people ADD COLUMN is_local INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,18 @@
+-- The schema as it was before migrations, which older
+-- databases are adopted at
+CREATE TABLE status (id INTEGER PRIMARY KEY, value TEXT);
+INSERT INTO status (value) VALUES ('In');
+INSERT INTO status (value) VALUES ('Out');
+INSERT INTO status (value) VALUES ('In Field');
+
+CREATE TABLE people (id INTEGER PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT null, mobile TEXT not null default '', telephone TEXT not null default '', office TEXT not null default '', title TEXT not null default '', status int REFERENCES status(id), notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time datetime DEFAULT CURRENT_TIMESTAMP, is_deleted INTEGER NOT NULL DEFAULT 0, deleted_at DATETIME NULL);
+
+CREATE TABLE sessions (id text PRIMARY KEY, person_id INTEGER REFERENCES people(id), create_time DATETIME DEFAULT CURRENT_TIMESTAMP, roles TEXT NOT NULL DEFAULT '');
+
+CREATE TABLE api_tokens (id INTEGER PRIMARY KEY, person_id INTEGER REFERENCES people(id), name TEXT NOT NULL DEFAULT '', token_hash TEXT UNIQUE NOT NULL, scopes TEXT NOT NULL DEFAULT '', create_time DATETIME DEFAULT CURRENT_TIMESTAMP, expire_time DATETIME NULL, last_used DATETIME NULL);
+
+CREATE TABLE login_attempts (kind TEXT NOT NULL, key TEXT NOT NULL, failures INTEGER NOT NULL DEFAULT 0, last_failure DATETIME NULL, locked_until DATETIME NULL, PRIMARY KEY (kind, key));
+
+CREATE TABLE sync_runs (id INTEGER PRIMARY KEY, trigger TEXT NOT NULL, start_time DATETIME NOT NULL, end_time DATETIME NULL, added INTEGER NOT NULL DEFAULT 0, updated INTEGER NOT NULL DEFAULT 0, removed INTEGER NOT NULL DEFAULT 0, errors INTEGER NOT NULL DEFAULT 0, message TEXT NOT NULL DEFAULT '');
+
+CREATE TABLE sync_cursors (directory TEXT PRIMARY KEY, attribute TEXT NOT NULL, value TEXT NOT NULL, server TEXT NOT NULL DEFAULT '', full_sync_time DATETIME NOT NULL);
@@ -0,0 +1,15 @@
+-- Foreign keys are enforced from this version on. Drop
+-- references to people who were deleted before people were
+-- kept when they left, and the foreign key on people.status,
+-- as in PostgreSQL, since new people are given status 0,
+-- which isn't one of the status codes.
+DELETE FROM sessions WHERE person_id NOT IN (SELECT id FROM people);
+DELETE FROM api_tokens WHERE person_id NOT IN (SELECT id FROM people);
+UPDATE people SET last_editor = NULL WHERE last_editor NOT IN (SELECT id FROM people);
+
+CREATE TABLE people_new (id INTEGER PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT NULL, mobile TEXT NOT NULL DEFAULT '', telephone TEXT NOT NULL DEFAULT '', office TEXT NOT NULL DEFAULT '', title TEXT NOT NULL DEFAULT '', status INTEGER NOT NULL DEFAULT 0, notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time DATETIME DEFAULT CURRENT_TIMESTAMP, is_deleted INTEGER NOT NULL DEFAULT 0, deleted_at DATETIME NULL);
+INSERT INTO people_new (id, username, name, department, mobile, telephone, office, title, status, notes, last_editor, last_edit_time, is_deleted, deleted_at)
+	SELECT id, username, name, department, mobile, telephone, office, title, coalesce(status, 0), notes, last_editor, last_edit_time, is_deleted, deleted_at FROM people;
+DROP TABLE people;
+ALTER TABLE people_new RENAME TO people;
+CREATE INDEX people_is_deleted ON people (is_deleted, department, name);
@@ -0,0 +1,5 @@
+-- Boards, for more than one site in one service. Boards are
+-- named in the config file. Everyone starts on the default
+-- board, and status codes without a board are on every board.
+ALTER TABLE people ADD COLUMN board TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE status ADD COLUMN board TEXT NULL;
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Open an empty SQLite database in a temporary directory
+func openTestStore(tb testing.TB) *sqlStore {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "inoutboard.db")
+	s, err := newSqlStore(dialectSqlite, "sqlite3", "file:"+path+sqliteOptions, 4)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+// the schema of a database from before there were migrations
+var legacySchema = []string{
+	"CREATE TABLE status (id INTEGER PRIMARY KEY, value TEXT)",
+	"INSERT INTO status (value) VALUES ('In'), ('Out'), ('In Field')",
+	"CREATE TABLE people (id INTEGER PRIMARY KEY, username TEXT UNIQUE, name TEXT NOT NULL, department TEXT null, mobile TEXT not null default '', telephone TEXT not null default '', office TEXT not null default '', title TEXT not null default '', status int REFERENCES status(id), notes TEXT DEFAULT '', last_editor INTEGER NULL REFERENCES people(id), last_edit_time datetime DEFAULT CURRENT_TIMESTAMP)",
+	"CREATE TABLE sessions (id text PRIMARY KEY, person_id INTEGER REFERENCES people(id), create_time DATETIME DEFAULT CURRENT_TIMESTAMP)",
+	"INSERT INTO people (username, name, department, status) VALUES ('bob', 'Bob Smith', 'Sales', 1)",
+}
+
+func TestMigrationStatusDoesNotChangeTheDatabase(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema []string
+		legacy bool
+	}{
+		{"new database", nil, false},
+		{"legacy database", legacySchema, true},
+		{"legacy database with an empty schema_version", append(legacySchema[:len(legacySchema):len(legacySchema)],
+			"CREATE TABLE schema_version (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_time TIMESTAMP NOT NULL)"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			for _, query := range tt.schema {
+				if _, err := s.db.Exec(query); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tables := func() string {
+				var names string
+				if err := s.db.QueryRow("SELECT coalesce(group_concat(name), '') FROM (SELECT name FROM sqlite_master ORDER BY name)").Scan(&names); err != nil {
+					t.Fatal(err)
+				}
+				return names
+			}
+			before := tables()
+
+			var out bytes.Buffer
+			if err := s.MigrationStatus(&out); err != nil {
+				t.Fatal(err)
+			}
+			if after := tables(); after != before {
+				t.Errorf("--migrate-status changed the schema from %q to %q", before, after)
+			}
+			if got := strings.Contains(out.String(), "not yet adopted"); got != tt.legacy {
+				t.Errorf("--migrate-status reported the database as legacy = %v, want %v:\n%s", got, tt.legacy, out.String())
+			}
+			if strings.Contains(out.String(), "applied") {
+				t.Errorf("--migrate-status reported migrations as applied:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestMigrateAdoptsLegacyDatabases(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema []string
+	}{
+		{"new database", nil},
+		{"legacy database", legacySchema},
+		{"legacy database with an empty schema_version", append(legacySchema[:len(legacySchema):len(legacySchema)],
+			"CREATE TABLE schema_version (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_time TIMESTAMP NOT NULL)")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			for _, query := range tt.schema {
+				if _, err := s.db.Exec(query); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Migrate(); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := s.MigrationStatus(&out); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(out.String(), "pending") || strings.Contains(out.String(), "not yet adopted") {
+				t.Errorf("migrations left after migrating:\n%s", out.String())
+			}
+			// migrating again changes nothing
+			if err := s.Migrate(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.schema != nil {
+				var name string
+				if err := s.db.QueryRow("SELECT name FROM people WHERE username = 'bob'").Scan(&name); err != nil || name != "Bob Smith" {
+					t.Errorf("bob after migrating = %q, %v", name, err)
+				}
+			}
+		})
+	}
+}
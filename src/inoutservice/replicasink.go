@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Somewhere replicas of the database are kept. Names are
+// slash-separated paths, like generations/<id>/snapshot.db.
+type ReplicaSink interface {
+	// store an object, replacing any with the same name
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	// the names of the objects under a prefix, in order
+	List(prefix string) ([]string, error)
+	// delete everything under a prefix
+	Delete(prefix string) error
+}
+
+// Ways of opening a sink, by the scheme of the Destination in
+// the [Replication] section, eg: file:///var/lib/inoutboard/replica.
+// Other kinds of storage can add themselves here.
+var replicaSinks = map[string]func(location string) (ReplicaSink, error){
+	"file": newDirectorySink,
+}
+
+// Open the sink for a destination. A destination without
+// a scheme is a local directory.
+func openReplicaSink(destination string) (ReplicaSink, error) {
+	scheme, location, ok := strings.Cut(destination, "://")
+	if !ok {
+		scheme, location = "file", destination
+	}
+	open, ok := replicaSinks[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown replication destination %q", destination)
+	}
+	return open(location)
+}
+
+// A sink in a local directory, eg: on another disk or
+// a network mount
+type directorySink struct {
+	root string
+}
+
+func newDirectorySink(location string) (ReplicaSink, error) {
+	if location == "" {
+		return nil, fmt.Errorf("the replication directory is empty")
+	}
+	if err := os.MkdirAll(location, 0700); err != nil {
+		return nil, err
+	}
+	return &directorySink{root: location}, nil
+}
+
+// Write to a temporary file and rename it into place, so
+// a partly written object is never seen
+func (d *directorySink) Put(name string, r io.Reader) error {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *directorySink) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+}
+
+func (d *directorySink) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	start := filepath.Join(d.root, filepath.FromSlash(prefix))
+	err := filepath.WalkDir(start, func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (d *directorySink) Delete(prefix string) error {
+	return os.RemoveAll(filepath.Join(d.root, filepath.FromSlash(prefix)))
+}
+
+func (d *directorySink) String() string {
+	return d.root
+}
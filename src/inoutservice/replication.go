@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Continuous replication of the SQLite database. The replica is
+// made of generations, each a snapshot of the database followed
+// by segments of its write-ahead log (WAL) holding the
+// transactions committed after it:
+//
+//	generations/<time>/snapshot.db
+//	generations/<time>/wal/<offset>-<time>.wal
+//
+// The service checkpoints the WAL itself, rather than leaving it
+// to SQLite, so that nothing is checkpointed before it has been
+// shipped. Each checkpoint starts a new generation.
+
+// Default replication settings
+const (
+	defaultReplicationSeconds = 10
+	defaultSnapshotHours      = 24
+	defaultRetentionHours     = 72
+	defaultMaxWalMegabytes    = 16
+)
+
+// the format of times in replica names, which sort in time order
+const replicaTimeFormat = "20060102T150405.000000000Z"
+
+// the SQLite driver for a replicated database, which leaves
+// checkpoints to the replicator
+const sqliteReplicatedDriver = "sqlite3_replicated"
+
+// sizes in the WAL file format
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	// the WAL magic number, with the low bit set if the
+	// checksums are big-endian
+	walMagic = 0x377f0682
+)
+
+// Ships the database's WAL, and snapshots of it, to a sink
+type replicator struct {
+	store *sqlStore
+	// held open, so SQLite doesn't checkpoint and delete the
+	// WAL on its own when the last other connection closes
+	conn             *sql.Conn
+	dbPath           string
+	sink             ReplicaSink
+	interval         time.Duration
+	snapshotInterval time.Duration
+	retention        time.Duration
+	maxWal           int64
+
+	// the current generation
+	generation   string
+	snapshotTime time.Time
+	// how much of the WAL has been shipped, the WAL's salts,
+	// and the running checksum at that point
+	offset    int64
+	salt      []byte
+	checksum  [2]uint32
+	bigEndian bool
+	pageSize  int64
+}
+
+// Set up replication from the [Replication] section of the
+// config file
+func newReplicator(cfg *Config, s Store) (*replicator, error) {
+	sqlite, ok := s.(*sqlStore)
+	if !ok || sqlite.dialect != dialectSqlite {
+		return nil, errors.New("replication is only supported for SQLite")
+	}
+	sink, err := openReplicaSink(cfg.Replication.Destination)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlite.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	r := &replicator{
+		store:            sqlite,
+		conn:             conn,
+		dbPath:           cfg.Files.DbPath,
+		sink:             sink,
+		interval:         time.Duration(cfg.Replication.IntervalSeconds) * time.Second,
+		snapshotInterval: time.Duration(cfg.Replication.SnapshotHours) * time.Hour,
+		retention:        time.Duration(cfg.Replication.RetentionHours) * time.Hour,
+		maxWal:           int64(cfg.Replication.MaxWalMegabytes) << 20,
+	}
+	if r.interval <= 0 {
+		r.interval = defaultReplicationSeconds * time.Second
+	}
+	if r.snapshotInterval <= 0 {
+		r.snapshotInterval = defaultSnapshotHours * time.Hour
+	}
+	if r.retention <= 0 {
+		r.retention = defaultRetentionHours * time.Hour
+	}
+	if r.maxWal <= 0 {
+		r.maxWal = defaultMaxWalMegabytes << 20
+	}
+	return r, nil
+}
+
+// Replicate every interval, until the program exits
+func (r *replicator) run() {
+	log.Infof("Replicating the database to %s every %s", r.sink, r.interval)
+	ticker := time.NewTicker(r.interval)
+	for ; true; <-ticker.C {
+		if err := r.step(); err != nil {
+			log.Errorf("Replication failed: %s", err)
+		}
+	}
+}
+
+// Ship any newly committed transactions, starting a new
+// generation when it's time for a snapshot, the WAL has grown
+// too big, or the WAL was reset behind our back
+func (r *replicator) step() error {
+	if r.generation == "" || time.Since(r.snapshotTime) > r.snapshotInterval {
+		return r.newGeneration()
+	}
+	size, reset, err := r.ship()
+	if err != nil {
+		return err
+	}
+	if reset {
+		log.Warn("The WAL was reset outside of replication; starting a new generation")
+		return r.newGeneration()
+	}
+	if size > r.maxWal {
+		return r.newGeneration()
+	}
+	return nil
+}
+
+// Checkpoint the WAL into the database, and start a new
+// generation with a snapshot. Whatever was committed since the
+// last shipment is shipped first, to finish the old generation.
+func (r *replicator) newGeneration() error {
+	if r.generation != "" {
+		if _, _, err := r.ship(); err != nil {
+			log.Errorf("Could not finish replica generation %s: %s", r.generation, err)
+		}
+	}
+
+	var busy, walFrames, checkpointed int
+	if err := r.conn.QueryRowContext(context.Background(), "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &walFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return errors.New("the database was too busy to checkpoint; trying again later")
+	}
+
+	// anything committed from here on is in the snapshot, in
+	// the WAL, or both, which does no harm
+	now := time.Now().UTC()
+	generation := now.Format(replicaTimeFormat)
+	tmp := r.dbPath + ".snapshot"
+	if err := r.store.Backup(tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = r.sink.Put("generations/"+generation+"/snapshot.db", f); err != nil {
+		return err
+	}
+	log.Infof("Started replica generation %s", generation)
+
+	r.generation = generation
+	r.snapshotTime = now
+	r.offset = 0
+	r.salt = nil
+	r.prune()
+	return nil
+}
+
+// Ship the transactions committed to the WAL since the last
+// shipment. Returns the size of the WAL, and whether it was
+// reset since the last shipment, in which case nothing is shipped.
+func (r *replicator) ship() (int64, bool, error) {
+	f, err := os.Open(r.dbPath + "-wal")
+	if os.IsNotExist(err) {
+		return 0, r.offset > 0, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := info.Size()
+	if size < walHeaderSize {
+		return size, r.offset > 0, nil
+	}
+
+	header := make([]byte, walHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return size, false, err
+	}
+	if binary.BigEndian.Uint32(header)&^1 != walMagic {
+		return size, false, errors.New("the WAL file has a bad header")
+	}
+	if r.offset > 0 && (!bytes.Equal(header[16:24], r.salt) || size < r.offset) {
+		return size, true, nil
+	}
+	if r.offset == 0 {
+		r.bigEndian = binary.BigEndian.Uint32(header)&1 == 1
+		r.pageSize = int64(binary.BigEndian.Uint32(header[8:12]))
+		checksum := walChecksum(r.bigEndian, [2]uint32{}, header[:24])
+		if checksum != [2]uint32{binary.BigEndian.Uint32(header[24:28]), binary.BigEndian.Uint32(header[28:32])} {
+			// the header is still being written
+			return size, false, nil
+		}
+		r.salt = append([]byte(nil), header[16:24]...)
+		r.checksum = checksum
+	}
+
+	// find the end of the last complete, committed transaction,
+	// checking each frame against the running checksum
+	frameSize := walFrameHeaderSize + r.pageSize
+	frame := make([]byte, frameSize)
+	checksum := r.checksum
+	end, endChecksum := r.offset, r.checksum
+	pos := r.offset
+	if pos < walHeaderSize {
+		pos = walHeaderSize
+	}
+	for ; pos+frameSize <= size; pos += frameSize {
+		if _, err = f.ReadAt(frame, pos); err != nil {
+			return size, false, err
+		}
+		if !bytes.Equal(frame[8:16], r.salt) {
+			break
+		}
+		checksum = walChecksum(r.bigEndian, checksum, frame[:8])
+		checksum = walChecksum(r.bigEndian, checksum, frame[walFrameHeaderSize:])
+		if checksum != [2]uint32{binary.BigEndian.Uint32(frame[16:20]), binary.BigEndian.Uint32(frame[20:24])} {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 { // a commit
+			end, endChecksum = pos+frameSize, checksum
+		}
+	}
+	if end <= r.offset {
+		return size, false, nil
+	}
+
+	name := fmt.Sprintf("generations/%s/wal/%016x-%s.wal", r.generation, r.offset, time.Now().UTC().Format(replicaTimeFormat))
+	if err = r.sink.Put(name, io.NewSectionReader(f, r.offset, end-r.offset)); err != nil {
+		return size, false, err
+	}
+	log.Debugf("Shipped %d bytes of WAL to %s", end-r.offset, name)
+	r.offset, r.checksum = end, endChecksum
+	return size, false, nil
+}
+
+// The WAL checksum of some data, continuing from a previous
+// checksum
+func walChecksum(bigEndian bool, checksum [2]uint32, data []byte) [2]uint32 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	s0, s1 := checksum[0], checksum[1]
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+	return [2]uint32{s0, s1}
+}
+
+// Delete generations that are no longer needed to restore to
+// any time within the retention period
+func (r *replicator) prune() {
+	generations, err := replicaGenerations(r.sink)
+	if err != nil {
+		log.Errorf("Could not list replica generations: %s", err)
+		return
+	}
+	cutoff := time.Now().Add(-r.retention)
+	for i := 0; i+1 < len(generations); i++ {
+		if next, err := time.Parse(replicaTimeFormat, generations[i+1]); err == nil && next.Before(cutoff) {
+			log.Infof("Deleting replica generation %s", generations[i])
+			if err = r.sink.Delete("generations/" + generations[i]); err != nil {
+				log.Errorf("Could not delete replica generation %s: %s", generations[i], err)
+			}
+		}
+	}
+}
+
+// List the generations in a sink, oldest first
+func replicaGenerations(sink ReplicaSink) ([]string, error) {
+	names, err := sink.List("generations")
+	if err != nil {
+		return nil, err
+	}
+	generations := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) < 3 || seen[parts[1]] {
+			continue
+		}
+		if _, err := time.Parse(replicaTimeFormat, parts[1]); err != nil {
+			continue
+		}
+		seen[parts[1]] = true
+		generations = append(generations, parts[1])
+	}
+	sort.Strings(generations)
+	return generations, nil
+}
+
+// Rebuild the database as it was at a time from a replica,
+// writing it to output. This is the --restore-replica command;
+// the result can be put in place with --restore.
+func restoreReplica(destination string, output string, at time.Time) error {
+	sink, err := openReplicaSink(destination)
+	if err != nil {
+		return err
+	}
+	generations, err := replicaGenerations(sink)
+	if err != nil {
+		return err
+	}
+	var generation string
+	for _, g := range generations {
+		if started, _ := time.Parse(replicaTimeFormat, g); !started.After(at) {
+			generation = g
+		}
+	}
+	if generation == "" {
+		return fmt.Errorf("the replica has nothing from before %s", at.Format(time.RFC3339))
+	}
+
+	tmp := output + ".tmp"
+	if err = copyFromSink(sink, "generations/"+generation+"/snapshot.db", tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	restoredTo, err := applyWal(sink, generation, tmp, at)
+	if err != nil {
+		return err
+	}
+	if _, err = checkBackup(tmp); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, output); err != nil {
+		return err
+	}
+	fmt.Printf("Restored the database as it was at %s to %s\n", restoredTo.Local().Format(time.RFC3339), output)
+	return nil
+}
+
+// copy an object from a sink to a file
+func copyFromSink(sink ReplicaSink, name string, path string) error {
+	r, err := sink.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Apply the WAL segments of a generation shipped up to a time
+// to its snapshot, by writing each committed page into the
+// database file. Returns the time it was restored to.
+func applyWal(sink ReplicaSink, generation string, path string, at time.Time) (time.Time, error) {
+	restoredTo, _ := time.Parse(replicaTimeFormat, generation)
+	names, err := sink.List("generations/" + generation + "/wal")
+	if err != nil {
+		return restoredTo, err
+	}
+	db, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return restoredTo, err
+	}
+	defer db.Close()
+
+	var expected int64
+	var pageSize int64
+	for _, name := range names {
+		base := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".wal")
+		offsetHex, timeText, ok := strings.Cut(base, "-")
+		offset, err := strconv.ParseInt(offsetHex, 16, 64)
+		shipped, timeErr := time.Parse(replicaTimeFormat, timeText)
+		if !ok || err != nil || timeErr != nil {
+			continue
+		}
+		if shipped.After(at) {
+			break
+		}
+		if offset != expected {
+			return restoredTo, fmt.Errorf("the replica is missing WAL from offset %d in generation %s", expected, generation)
+		}
+
+		segment, err := sink.Get(name)
+		if err != nil {
+			return restoredTo, err
+		}
+		data, err := io.ReadAll(segment)
+		segment.Close()
+		if err != nil {
+			return restoredTo, err
+		}
+		expected = offset + int64(len(data))
+		if offset == 0 {
+			if len(data) < walHeaderSize {
+				return restoredTo, fmt.Errorf("%s is too short", name)
+			}
+			pageSize = int64(binary.BigEndian.Uint32(data[8:12]))
+			data = data[walHeaderSize:]
+		}
+		if err = applyFrames(db, data, pageSize); err != nil {
+			return restoredTo, fmt.Errorf("%s: %w", name, err)
+		}
+		restoredTo = shipped
+	}
+	return restoredTo, db.Sync()
+}
+
+// Write the pages of the committed transactions in some WAL
+// frames into a database file
+func applyFrames(db *os.File, data []byte, pageSize int64) error {
+	if pageSize == 0 {
+		return errors.New("the WAL header is missing")
+	}
+	frameSize := walFrameHeaderSize + pageSize
+	pending := make([][]byte, 0)
+	for len(data) > 0 {
+		if int64(len(data)) < frameSize {
+			return errors.New("the WAL ends in the middle of a frame")
+		}
+		frame := data[:frameSize]
+		data = data[frameSize:]
+		pending = append(pending, frame)
+		commit := binary.BigEndian.Uint32(frame[4:8])
+		if commit == 0 {
+			continue
+		}
+		for _, f := range pending {
+			page := int64(binary.BigEndian.Uint32(f[0:4]))
+			if _, err := db.WriteAt(f[walFrameHeaderSize:], (page-1)*pageSize); err != nil {
+				return err
+			}
+		}
+		if err := db.Truncate(int64(commit) * pageSize); err != nil {
+			return err
+		}
+		pending = pending[:0]
+	}
+	return nil
+}
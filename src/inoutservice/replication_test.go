@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalChecksum(t *testing.T) {
+	tests := []struct {
+		name      string
+		bigEndian bool
+		start     [2]uint32
+		data      []byte
+		want      [2]uint32
+	}{
+		{"no data", false, [2]uint32{5, 7}, nil, [2]uint32{5, 7}},
+		{"little endian", false, [2]uint32{}, []byte{1, 0, 0, 0, 2, 0, 0, 0}, [2]uint32{1, 3}},
+		{"big endian", true, [2]uint32{}, []byte{0, 0, 0, 1, 0, 0, 0, 2}, [2]uint32{1, 3}},
+		{"continues from the start", false, [2]uint32{10, 20}, []byte{1, 0, 0, 0, 2, 0, 0, 0}, [2]uint32{31, 53}},
+		{"two blocks", false, [2]uint32{}, []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0}, [2]uint32{7, 14}},
+		{"ignores a partial block", false, [2]uint32{}, []byte{1, 0, 0, 0, 2, 0, 0, 0, 9, 9, 9}, [2]uint32{1, 3}},
+		{"wraps around", false, [2]uint32{0xffffffff, 1}, []byte{1, 0, 0, 0, 0, 0, 0, 0}, [2]uint32{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walChecksum(tt.bigEndian, tt.start, tt.data); got != tt.want {
+				t.Errorf("walChecksum = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The checksums in a WAL written by SQLite itself
+func TestWalChecksumMatchesSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, query := range []string{
+		"PRAGMA wal_autocheckpoint = 0",
+		"CREATE TABLE t (v TEXT)",
+		"INSERT INTO t (v) VALUES ('one'), ('two')",
+		"INSERT INTO t (v) VALUES ('three')",
+	} {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal) < walHeaderSize {
+		t.Fatalf("the WAL is only %d bytes", len(wal))
+	}
+
+	bigEndian := binary.BigEndian.Uint32(wal[0:4])&1 == 1
+	pageSize := int64(binary.BigEndian.Uint32(wal[8:12]))
+	checksum := walChecksum(bigEndian, [2]uint32{}, wal[:24])
+	if want := [2]uint32{binary.BigEndian.Uint32(wal[24:28]), binary.BigEndian.Uint32(wal[28:32])}; checksum != want {
+		t.Fatalf("header checksum = %v, SQLite wrote %v", checksum, want)
+	}
+	frames := 0
+	for pos := int64(walHeaderSize); pos+walFrameHeaderSize+pageSize <= int64(len(wal)); pos += walFrameHeaderSize + pageSize {
+		frame := wal[pos : pos+walFrameHeaderSize+pageSize]
+		checksum = walChecksum(bigEndian, checksum, frame[:8])
+		checksum = walChecksum(bigEndian, checksum, frame[walFrameHeaderSize:])
+		if want := [2]uint32{binary.BigEndian.Uint32(frame[16:20]), binary.BigEndian.Uint32(frame[20:24])}; checksum != want {
+			t.Fatalf("frame %d checksum = %v, SQLite wrote %v", frames, checksum, want)
+		}
+		frames++
+	}
+	if frames == 0 {
+		t.Fatal("the WAL has no frames")
+	}
+}
+
+func TestApplyFrames(t *testing.T) {
+	const pageSize = 8
+	frame := func(page uint32, commit uint32, fill byte) []byte {
+		f := make([]byte, walFrameHeaderSize+pageSize)
+		binary.BigEndian.PutUint32(f[0:4], page)
+		binary.BigEndian.PutUint32(f[4:8], commit)
+		copy(f[walFrameHeaderSize:], bytes.Repeat([]byte{fill}, pageSize))
+		return f
+	}
+	frames := func(f ...[]byte) []byte { return bytes.Join(f, nil) }
+	pages := func(fills ...byte) []byte {
+		db := make([]byte, 0, len(fills)*pageSize)
+		for _, fill := range fills {
+			db = append(db, bytes.Repeat([]byte{fill}, pageSize)...)
+		}
+		return db
+	}
+
+	tests := []struct {
+		name     string
+		db       []byte
+		data     []byte
+		pageSize int64
+		want     []byte
+		wantErr  bool
+	}{
+		{"no frames", pages('a', 'b'), nil, pageSize, pages('a', 'b'), false},
+		{"one transaction", pages('a', 'b'), frames(frame(2, 2, 'x')), pageSize, pages('a', 'x'), false},
+		{"a transaction of several frames", pages('a', 'b'),
+			frames(frame(1, 0, 'x'), frame(3, 3, 'y')), pageSize, pages('x', 'b', 'y'), false},
+		{"later frames for a page win", pages('a'),
+			frames(frame(1, 1, 'x'), frame(1, 1, 'y')), pageSize, pages('y'), false},
+		{"an uncommitted transaction is left out", pages('a', 'b'),
+			frames(frame(1, 2, 'x'), frame(2, 0, 'y')), pageSize, pages('x', 'b'), false},
+		{"a commit shrinks the database", pages('a', 'b', 'c'), frames(frame(1, 1, 'x')), pageSize, pages('x'), false},
+		{"a frame cut short", pages('a'), frames(frame(1, 1, 'x'))[:walFrameHeaderSize+2], pageSize, nil, true},
+		{"no WAL header", pages('a'), frames(frame(1, 1, 'x')), 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "restored.db")
+			if err := os.WriteFile(path, tt.db, 0600); err != nil {
+				t.Fatal(err)
+			}
+			db, err := os.OpenFile(path, os.O_RDWR, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			err = applyFrames(db, tt.data, tt.pageSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyFrames error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("database after applyFrames = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
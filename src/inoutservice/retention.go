@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kinds of data that are only kept for a while
+const (
+	retentionSessions      = "sessions"
+	retentionSyncHistory   = "sync-history"
+	retentionExpiredTokens = "expired-tokens"
+	retentionDeletedPeople = "deleted-people"
+)
+
+// the order the janitor goes through them
+var retentionKinds = []string{retentionSessions, retentionSyncHistory, retentionExpiredTokens, retentionDeletedPeople}
+
+// The table each kind is in, the column that ages it and
+// which rows are eligible at all. Deleted people aren't
+// here, as they're purged one at a time with PurgePerson.
+var retentionTables = map[string]struct {
+	table  string
+	column string
+	where  string
+}{
+	retentionSessions:      {"sessions", "create_time", "1 = 1"},
+	retentionSyncHistory:   {"sync_runs", "start_time", "end_time IS NOT NULL"},
+	retentionExpiredTokens: {"api_tokens", "expire_time", "expire_time IS NOT NULL"},
+}
+
+// sessions outlive their cookie by this when the config
+// file doesn't say
+const defaultSessionDays = 365
+
+const defaultJanitorHours = 24
+
+// How long one kind of data is kept. Zero keeps it forever.
+type retentionPolicy struct {
+	days   int
+	months int
+}
+
+// the time before which data is purged, or the zero time
+// if it's kept forever
+func (p retentionPolicy) cutoff(now time.Time) time.Time {
+	if p.days <= 0 && p.months <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, -p.months, -p.days).UTC()
+}
+
+func (p retentionPolicy) String() string {
+	switch {
+	case p.months > 0:
+		return fmt.Sprintf("%d months", p.months)
+	case p.days > 0:
+		return fmt.Sprintf("%d days", p.days)
+	}
+	return "forever"
+}
+
+// How long each kind of data is kept, and how often the
+// janitor enforces it. Set from the config file.
+type retentionSettings struct {
+	interval time.Duration
+	policies map[string]retentionPolicy
+}
+
+var retention retentionSettings
+
+// Get the retention policies from the config file
+func retentionFromConfig(cfg *Config) retentionSettings {
+	r := retentionSettings{
+		interval: time.Duration(cfg.Retention.IntervalHours) * time.Hour,
+		policies: map[string]retentionPolicy{
+			retentionSessions:      {days: cfg.Retention.SessionDays},
+			retentionSyncHistory:   {months: cfg.Retention.SyncHistoryMonths},
+			retentionExpiredTokens: {days: cfg.Retention.ExpiredTokenDays},
+			retentionDeletedPeople: {days: cfg.Retention.DeletedPeopleDays},
+		},
+	}
+	if r.interval <= 0 {
+		r.interval = defaultJanitorHours * time.Hour
+	}
+	if cfg.Retention.SessionDays <= 0 {
+		r.policies[retentionSessions] = retentionPolicy{days: defaultSessionDays}
+	}
+	return r
+}
+
+// A cutoff as it compares with the stored times. SQLite
+// compares them as text. current_timestamp writes them without
+// fractions or a zone, but the driver adds both to a
+// time.Time, so a row written at the cutoff would sort before
+// it. Rows the driver wrote within the cutoff's second are
+// kept until the next run.
+func (s *sqlStore) cutoffArg(before time.Time) interface{} {
+	if s.dialect == dialectSqlite {
+		return before.UTC().Format("2006-01-02 15:04:05")
+	}
+	return before.UTC()
+}
+
+// Count the rows of a kind of data, and how many of them
+// are older than before
+func (s *sqlStore) CountRetained(kind string, before time.Time) (int, int, error) {
+	t, ok := retentionTables[kind]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown kind of data %q", kind)
+	}
+	var rows, due int
+	err := s.queryRow(fmt.Sprintf("SELECT count(*), count(CASE WHEN %s < ? THEN 1 END) FROM %s WHERE %s", t.column, t.table, t.where),
+		s.cutoffArg(before)).Scan(&rows, &due)
+	return rows, due, err
+}
+
+// Delete the rows of a kind of data older than before,
+// returning how many were deleted
+func (s *sqlStore) PurgeRetained(kind string, before time.Time) (int, error) {
+	t, ok := retentionTables[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown kind of data %q", kind)
+	}
+	res, err := s.exec(fmt.Sprintf("DELETE FROM %s WHERE %s AND %s < ?", t.table, t.where, t.column), s.cutoffArg(before))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// How much of one kind of data there is, and what the
+// janitor has done about it
+type RetentionCount struct {
+	Kind string
+	// how long it's kept, eg: "90 days", or "forever"
+	Keep string
+	Rows int
+	// rows older than the policy allows, which the next
+	// run of the janitor will purge
+	Due int
+	// purged by the last run, and since the service started
+	LastPurged  int
+	TotalPurged int
+}
+
+type RetentionReport struct {
+	Interval string
+	LastRun  *time.Time `json:",omitempty"`
+	Counts   []*RetentionCount
+}
+
+// What the janitor has done since the service started
+var janitor struct {
+	sync.Mutex
+	lastRun     *time.Time
+	lastPurged  map[string]int
+	totalPurged map[string]int
+}
+
+// Purge everything older than its retention policy allows,
+// logging what was purged. Returns how many of each kind were
+// purged. Kinds that fail don't stop the others.
+func runJanitor(now time.Time) (map[string]int, error) {
+	janitor.Lock()
+	defer janitor.Unlock()
+
+	purged := make(map[string]int)
+	var errs []error
+	for _, kind := range retentionKinds {
+		policy := retention.policies[kind]
+		before := policy.cutoff(now)
+		if before.IsZero() {
+			continue
+		}
+		var n int
+		var err error
+		if kind == retentionDeletedPeople {
+			n, err = purgeDeletedPeople(before)
+		} else {
+			n, err = store.PurgeRetained(kind, before)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("purging %s: %w", kind, err))
+		}
+		if n > 0 {
+			log.Infof("Purged %d %s older than %s", n, kind, policy)
+		}
+		purged[kind] = n
+	}
+
+	if janitor.totalPurged == nil {
+		janitor.totalPurged = make(map[string]int)
+	}
+	for kind, n := range purged {
+		janitor.totalPurged[kind] += n
+	}
+	janitor.lastPurged = purged
+	janitor.lastRun = &now
+	return purged, errors.Join(errs...)
+}
+
+// Permanently delete the people removed from the board
+// before a time
+func purgeDeletedPeople(before time.Time) (int, error) {
+	people, err := store.GetDeletedUsers()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, p := range people {
+		if p.DeletedAt == nil || !p.DeletedAt.Before(before) {
+			continue
+		}
+		if err = store.PurgePerson(p.Username); err != nil {
+			return purged, err
+		}
+		log.Infof("Purged %s (%s), removed from the board on %s", p.Username, p.Name, p.DeletedAt.Format("2006-01-02"))
+		purged++
+	}
+	return purged, nil
+}
+
+// Count each kind of data, and what the janitor would purge
+// if it ran now
+func retentionReport(now time.Time) (*RetentionReport, error) {
+	janitor.Lock()
+	defer janitor.Unlock()
+
+	report := &RetentionReport{Interval: retention.interval.String(), LastRun: janitor.lastRun}
+	for _, kind := range retentionKinds {
+		policy := retention.policies[kind]
+		count := &RetentionCount{
+			Kind:        kind,
+			Keep:        policy.String(),
+			LastPurged:  janitor.lastPurged[kind],
+			TotalPurged: janitor.totalPurged[kind],
+		}
+		before := policy.cutoff(now)
+		if kind == retentionDeletedPeople {
+			people, err := store.GetDeletedUsers()
+			if err != nil {
+				return nil, err
+			}
+			count.Rows = len(people)
+			for _, p := range people {
+				if !before.IsZero() && p.DeletedAt != nil && p.DeletedAt.Before(before) {
+					count.Due++
+				}
+			}
+		} else {
+			var err error
+			if count.Rows, count.Due, err = store.CountRetained(kind, before); err != nil {
+				return nil, err
+			}
+		}
+		report.Counts = append(report.Counts, count)
+	}
+	return report, nil
+}
+
+// Run the janitor now and every interval, until the
+// program exits
+func scheduleJanitor(interval time.Duration) {
+	log.Infof("Purging old data every %s", interval)
+	for {
+		if _, err := runJanitor(time.Now()); err != nil {
+			log.Errorf("Purging old data failed: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// The retention policies:
+//
+//	GET  /api/admin/retention shows them, with counts of what's kept and what's due
+//	POST /api/admin/retention runs the janitor now
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS, HEAD")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET", "HEAD":
+	case "POST":
+		log.Infof("%s ran the janitor", usernameFromContext(r.Context()))
+		if _, err := runJanitor(time.Now()); err != nil {
+			log.Errorf("Purging old data failed: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := retentionReport(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// when the janitor runs in these tests
+var retentionTestNow = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+// Use some retention policies for a test, with nothing purged
+// by the janitor yet
+func useRetention(tb testing.TB, cfg *Config) {
+	previous := retention
+	retention = retentionFromConfig(cfg)
+	tb.Cleanup(func() { retention = previous })
+
+	janitor.Lock()
+	janitor.lastRun, janitor.lastPurged, janitor.totalPurged = nil, nil, nil
+	janitor.Unlock()
+}
+
+// A time as SQLite's current_timestamp writes it
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// Put rows of every kind either side of the cutoffs for 30
+// days of sessions, 3 months of sync history, 7 days of
+// expired tokens and 90 days of deleted people. Rows named
+// "old..." are older than the cutoff; the rest are kept.
+// Times are written both as current_timestamp writes them
+// and as the driver writes a time.Time.
+func seedRetentionStore(t *testing.T, s *sqlStore) {
+	t.Helper()
+	sessions := retentionTestNow.AddDate(0, 0, -30)
+	runs := retentionTestNow.AddDate(0, -3, 0)
+	tokens := retentionTestNow.AddDate(0, 0, -7)
+	people := retentionTestNow.AddDate(0, 0, -90)
+
+	amy, err := s.AddPerson("amy", "Amy", "Sales", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"INSERT INTO sessions (id, person_id, create_time) VALUES (?, ?, ?)", []interface{}{"old-text", amy.ID, sqliteTime(sessions.Add(-time.Second))}},
+		{"INSERT INTO sessions (id, person_id, create_time) VALUES (?, ?, ?)", []interface{}{"old-time", amy.ID, sessions.Add(-time.Millisecond)}},
+		{"INSERT INTO sessions (id, person_id, create_time) VALUES (?, ?, ?)", []interface{}{"at-cutoff-text", amy.ID, sqliteTime(sessions)}},
+		{"INSERT INTO sessions (id, person_id, create_time) VALUES (?, ?, ?)", []interface{}{"at-cutoff-time", amy.ID, sessions}},
+		{"INSERT INTO sessions (id, person_id, create_time) VALUES (?, ?, ?)", []interface{}{"new-text", amy.ID, sqliteTime(sessions.Add(time.Second))}},
+
+		{"INSERT INTO sync_runs (trigger, start_time, end_time, message) VALUES ('schedule', ?, ?, ?)", []interface{}{runs.Add(-time.Second), runs, "old"}},
+		{"INSERT INTO sync_runs (trigger, start_time, end_time, message) VALUES ('schedule', ?, ?, ?)", []interface{}{sqliteTime(runs.Add(-time.Second)), sqliteTime(runs), "old-text"}},
+		{"INSERT INTO sync_runs (trigger, start_time, end_time, message) VALUES ('schedule', ?, ?, ?)", []interface{}{runs, runs.Add(time.Minute), "at-cutoff"}},
+		{"INSERT INTO sync_runs (trigger, start_time, end_time, message) VALUES ('schedule', ?, ?, ?)", []interface{}{sqliteTime(runs), sqliteTime(runs.Add(time.Minute)), "at-cutoff-text"}},
+		{"INSERT INTO sync_runs (trigger, start_time, message) VALUES ('schedule', ?, ?)", []interface{}{runs.AddDate(0, -1, 0), "unfinished"}},
+
+		{"INSERT INTO api_tokens (person_id, name, token_hash, expire_time) VALUES (?, ?, ?, ?)", []interface{}{amy.ID, "old", "hash-1", tokens.Add(-time.Second)}},
+		{"INSERT INTO api_tokens (person_id, name, token_hash, expire_time) VALUES (?, ?, ?, ?)", []interface{}{amy.ID, "at-cutoff", "hash-2", tokens}},
+		{"INSERT INTO api_tokens (person_id, name, token_hash, expire_time) VALUES (?, ?, ?, ?)", []interface{}{amy.ID, "expired", "hash-3", tokens.Add(time.Hour)}},
+		{"INSERT INTO api_tokens (person_id, name, token_hash, expire_time) VALUES (?, ?, ?, ?)", []interface{}{amy.ID, "valid", "hash-4", retentionTestNow.Add(time.Hour)}},
+		{"INSERT INTO api_tokens (person_id, name, token_hash) VALUES (?, ?, ?)", []interface{}{amy.ID, "never-expires", "hash-5"}},
+	} {
+		if _, err = s.exec(row.query, row.args...); err != nil {
+			t.Fatalf("%s: %s", row.query, err)
+		}
+	}
+
+	for username, deleted := range map[string]time.Time{
+		"old":       people.Add(-time.Second),
+		"at-cutoff": people,
+		"new":       people.Add(time.Second),
+	} {
+		p, err := s.AddPerson(username, username, "Sales", "", "", "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.RemovePerson(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.exec("UPDATE people SET deleted_at = ? WHERE username = ?", sqliteTime(deleted), username); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// the rows left of each kind, by their names
+func retainedRows(t *testing.T, s *sqlStore) map[string][]string {
+	t.Helper()
+	left := make(map[string][]string)
+	for kind, query := range map[string]string{
+		retentionSessions:      "SELECT id FROM sessions ORDER BY id",
+		retentionSyncHistory:   "SELECT message FROM sync_runs ORDER BY message",
+		retentionExpiredTokens: "SELECT name FROM api_tokens ORDER BY name",
+		retentionDeletedPeople: "SELECT username FROM people WHERE is_deleted = 1 ORDER BY username",
+	} {
+		rows, err := s.query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		left[kind] = []string{}
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			left[kind] = append(left[kind], name)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+	return left
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	tests := []struct {
+		policy retentionPolicy
+		want   time.Time
+	}{
+		{retentionPolicy{}, time.Time{}},
+		{retentionPolicy{days: -1}, time.Time{}},
+		{retentionPolicy{days: 30}, time.Date(2026, 9, 19, 12, 0, 0, 0, time.UTC)},
+		{retentionPolicy{months: 3}, time.Date(2026, 7, 19, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.cutoff(retentionTestNow.In(time.FixedZone("EST", -5*3600))); !got.Equal(tt.want) {
+			t.Errorf("%s cutoff = %s, want %s", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestRetentionFromConfig(t *testing.T) {
+	var cfg Config
+	r := retentionFromConfig(&cfg)
+	if r.interval != defaultJanitorHours*time.Hour {
+		t.Errorf("the janitor runs every %s, want %d hours", r.interval, defaultJanitorHours)
+	}
+	want := map[string]string{
+		retentionSessions:      "365 days",
+		retentionSyncHistory:   "forever",
+		retentionExpiredTokens: "forever",
+		retentionDeletedPeople: "forever",
+	}
+	for kind, keep := range want {
+		if got := r.policies[kind].String(); got != keep {
+			t.Errorf("by default, %s are kept %s, want %s", kind, got, keep)
+		}
+	}
+}
+
+func TestRunJanitor(t *testing.T) {
+	s := useTestStore(t)
+	var cfg Config
+	cfg.Retention.SessionDays = 30
+	cfg.Retention.SyncHistoryMonths = 3
+	cfg.Retention.ExpiredTokenDays = 7
+	cfg.Retention.DeletedPeopleDays = 90
+	useRetention(t, &cfg)
+	seedRetentionStore(t, s)
+
+	// what's due is counted before the janitor runs
+	report, err := retentionReport(retentionTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string][2]int)
+	for _, c := range report.Counts {
+		counts[c.Kind] = [2]int{c.Rows, c.Due}
+	}
+	wantCounts := map[string][2]int{
+		retentionSessions:      {5, 2},
+		retentionSyncHistory:   {4, 2},
+		retentionExpiredTokens: {4, 1},
+		retentionDeletedPeople: {3, 1},
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("rows and due = %v, want %v", counts, wantCounts)
+	}
+
+	purged, err := runJanitor(retentionTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPurged := map[string]int{
+		retentionSessions:      2,
+		retentionSyncHistory:   2,
+		retentionExpiredTokens: 1,
+		retentionDeletedPeople: 1,
+	}
+	if !reflect.DeepEqual(purged, wantPurged) {
+		t.Errorf("purged %v, want %v", purged, wantPurged)
+	}
+	wantLeft := map[string][]string{
+		retentionSessions:      {"at-cutoff-text", "at-cutoff-time", "new-text"},
+		retentionSyncHistory:   {"at-cutoff", "at-cutoff-text", "unfinished"},
+		retentionExpiredTokens: {"at-cutoff", "expired", "never-expires", "valid"},
+		retentionDeletedPeople: {"at-cutoff", "new"},
+	}
+	if left := retainedRows(t, s); !reflect.DeepEqual(left, wantLeft) {
+		t.Errorf("after the janitor ran, left %v, want %v", left, wantLeft)
+	}
+
+	// running again purges nothing more, and the totals are kept
+	if purged, err = runJanitor(retentionTestNow); err != nil {
+		t.Fatal(err)
+	}
+	for kind, n := range purged {
+		if n != 0 {
+			t.Errorf("running again purged %d %s", n, kind)
+		}
+	}
+	if report, err = retentionReport(retentionTestNow); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range report.Counts {
+		if c.Due != 0 || c.LastPurged != 0 || c.TotalPurged != wantPurged[c.Kind] {
+			t.Errorf("%s: %d due, %d last purged, %d in total; want 0, 0 and %d", c.Kind, c.Due, c.LastPurged, c.TotalPurged, wantPurged[c.Kind])
+		}
+	}
+}
+
+func TestRunJanitorKeepsForever(t *testing.T) {
+	s := useTestStore(t)
+	// only sessions have a default
+	useRetention(t, &Config{})
+	seedRetentionStore(t, s)
+	before := retainedRows(t, s)
+
+	// a year on, the sessions are older than the default
+	now := retentionTestNow.AddDate(1, 0, 0)
+	report, err := retentionReport(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range report.Counts {
+		if c.Kind == retentionSessions {
+			continue
+		}
+		if c.Keep != "forever" || c.Due != 0 {
+			t.Errorf("%s are kept %s with %d due, want forever with none", c.Kind, c.Keep, c.Due)
+		}
+	}
+
+	purged, err := runJanitor(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{retentionSessions: 5}; !reflect.DeepEqual(purged, want) {
+		t.Errorf("purged %v, want %v", purged, want)
+	}
+	left := retainedRows(t, s)
+	for _, kind := range []string{retentionSyncHistory, retentionExpiredTokens, retentionDeletedPeople} {
+		if !reflect.DeepEqual(left[kind], before[kind]) {
+			t.Errorf("%s left %v, want all of %v", kind, left[kind], before[kind])
+		}
+	}
+}
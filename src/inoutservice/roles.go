@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Application roles. A person's roles come from their
+// LDAP group memberships when they log in.
+const (
+	// may do anything, including everything the other roles can
+	RoleAdmin = "admin"
+	// front desk staff who keep the board up to date
+	RoleReception = "reception"
+	// fire and safety wardens
+	RoleWarden = "warden"
+	// department managers
+	RoleManager = "manager"
+)
+
+// The role of an admin of one board, eg: admin:london.
+// Admins are admins of every board.
+func boardAdminRole(board string) string {
+	return RoleAdmin + ":" + board
+}
+
+// Build the map of roles to LDAP group DNs from the
+// [Roles] section of the config file, and the admins
+// of each board from the [Board "name"] sections
+func roleGroupsFromConfig(cfg *Config) map[string][]string {
+	roleGroups := map[string][]string{
+		RoleAdmin:     cfg.Roles.Admin,
+		RoleReception: cfg.Roles.Reception,
+		RoleWarden:    cfg.Roles.Warden,
+		RoleManager:   cfg.Roles.Manager,
+	}
+	for name, bc := range cfg.Board {
+		roleGroups[boardAdminRole(name)] = bc.Admin
+	}
+	return roleGroups
+}
+
+// Work out the roles for a set of LDAP group DNs. DNs
+// are compared without regard to case or spacing.
+func rolesForGroups(roleGroups map[string][]string, groups []string) []string {
+	memberOf := make(map[string]bool)
+	for _, group := range groups {
+		memberOf[normalizeDN(group)] = true
+	}
+
+	// the application roles, then the board admin roles
+	order := []string{RoleAdmin, RoleReception, RoleWarden, RoleManager}
+	boardRoles := make([]string, 0)
+	for role := range roleGroups {
+		if strings.HasPrefix(role, RoleAdmin+":") {
+			boardRoles = append(boardRoles, role)
+		}
+	}
+	sort.Strings(boardRoles)
+	order = append(order, boardRoles...)
+
+	roles := make([]string, 0)
+	for _, role := range order {
+		for _, group := range roleGroups[role] {
+			if memberOf[normalizeDN(group)] {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// put a DN in a form that can be compared
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Only pass requests on to the next handler if the user
+// has a role. Admins have every role.
+func RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasRole(r.Context(), role) {
+			roleErr := Error{Message: "forbidden", Path: r.URL.Path}
+			content, _ := json.Marshal(roleErr)
+			http.Error(w, string(content), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check whether the user is an admin of a board
+func isBoardAdmin(ctx context.Context, board string) bool {
+	if hasRole(ctx, RoleAdmin) {
+		return true
+	}
+	for _, r := range rolesFromContext(ctx) {
+		if r == boardAdminRole(board) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the user is an admin of a board, responding
+// as RequireRole does if they aren't
+func requireBoardAdmin(w http.ResponseWriter, r *http.Request, board string) bool {
+	if isBoardAdmin(r.Context(), board) {
+		return true
+	}
+	roleErr := Error{Message: "forbidden", Path: r.URL.Path}
+	content, _ := json.Marshal(roleErr)
+	http.Error(w, string(content), http.StatusForbidden)
+	return false
+}
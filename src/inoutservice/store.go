@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Databases the board can be kept in
+const (
+	dialectSqlite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+// Where the board's data is kept
+type Store interface {
+	// sessions
+	ValidateSession(sessionID string) (string, []string, error)
+	CreateSession(sessionID string, userID int, roles []string) error
+	RemoveSession(sessionID string) error
+
+	// people
+	AddPerson(username string, name string, department string, telephone string, mobile string, office string, title string, board string) (*Person, error)
+	GetUsers() ([]*Person, error)
+	GetBoardUsers(board string) ([]*Person, error)
+	GetPerson(username string) (*Person, error)
+	SetPerson(person *Person, username string) error
+	SetPersonDetails(person *Person) error
+	MarkLocal(username string) error
+	RemovePerson(person *Person) error
+	GetDeletedUsers() ([]*Person, error)
+	RestorePerson(username string) error
+	PurgePerson(username string) error
+
+	// status codes
+	StatusCodes() (map[int]Status, error)
+	AddStatus(board string, value string) (*Status, error)
+	RemoveStatus(board string, code int) error
+
+	// API tokens
+	CreateToken(username string, name string, tokenHash string, scopes []string, expires NullTime) (*APIToken, error)
+	ValidateToken(tokenHash string) (string, []string, error)
+	GetTokens(username string) ([]*APIToken, error)
+	GetToken(username string, id int) (*APIToken, error)
+	RemoveToken(username string, id int) error
+
+	// failed logins
+	GetLoginAttempts() ([]*loginAttempts, error)
+	SaveLoginAttempts(a *loginAttempts) error
+	RemoveLoginAttempts(kind string, key string) error
+
+	// LDAP syncs
+	CreateSyncRun(run *SyncRun) error
+	FinishSyncRun(run *SyncRun) error
+	GetSyncRuns(limit int) ([]*SyncRun, error)
+	GetSyncCursor(directory string) (*SyncCursor, error)
+	SaveSyncCursor(cursor *SyncCursor) error
+
+	// the whole board, for moving it elsewhere
+	ExportBoard(history bool) (*BoardExport, error)
+	ImportBoard(b *BoardExport, conflict string) (*ImportResult, error)
+
+	// data that is only kept for a while, see retention.go
+	CountRetained(kind string, before time.Time) (int, int, error)
+	PurgeRetained(kind string, before time.Time) (int, error)
+
+	// the schema
+	Migrate() error
+	MigrationStatus(out io.Writer) error
+
+	// make a consistent copy of the database while it's in use
+	Backup(path string) error
+
+	Close() error
+}
+
+// the store, opened from the config file
+var store Store
+
+// connections kept open to the database, when the config
+// file doesn't say
+const defaultMaxConnections = 8
+
+// Connection settings for SQLite: a write-ahead log, so
+// readers don't wait for writers, waiting up to 5 seconds
+// for a lock, foreign keys enforced, and transactions that
+// take the write lock when they start, so two can't each
+// wait for the other to finish reading
+const sqliteOptions = "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_synchronous=NORMAL&_txlock=immediate"
+
+func init() {
+	// a replicated database checkpoints its write-ahead log
+	// only once the replicator has shipped it
+	sql.Register(sqliteReplicatedDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA wal_autocheckpoint = 0", nil)
+			return err
+		},
+	})
+}
+
+// Open the store the config file asks for. Its schema is
+// brought up to date by Migrate.
+func openStore(cfg *Config) (Store, error) {
+	poolSize := cfg.Database.MaxConnections
+	if poolSize <= 0 {
+		poolSize = defaultMaxConnections
+	}
+	switch strings.ToLower(cfg.Database.Driver) {
+	case "", dialectSqlite, "sqlite3":
+		if cfg.Files.DbPath == "" {
+			return nil, fmt.Errorf("DbPath must be defined in the [Files] section of the config file")
+		}
+		driver := "sqlite3"
+		if cfg.Replication.Destination != "" {
+			driver = sqliteReplicatedDriver
+		}
+		return newSqlStore(dialectSqlite, driver, cfg.Files.DbPath+sqliteOptions, poolSize)
+	case dialectPostgres, "postgresql":
+		if cfg.Database.URL == "" {
+			return nil, fmt.Errorf("URL must be defined in the [Database] section of the config file")
+		}
+		return newSqlStore(dialectPostgres, "postgres", cfg.Database.URL, poolSize)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", cfg.Database.Driver)
+}
+
+// A store in an SQL database. The queries are written for
+// SQLite, with ? placeholders, and rewritten for Postgres.
+// Each query is prepared the first time it's used, and the
+// statement kept until the store is closed.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+
+	// prepared statements, by query
+	stmts     map[string]*sql.Stmt
+	stmtMutex sync.Mutex
+
+	// cached status codes
+	statusCodes map[int]Status
+	mutex       sync.Mutex
+}
+
+// Open a database with a database/sql driver, keeping up to
+// poolSize connections open
+func newSqlStore(dialect string, driver string, source string, poolSize int) (*sqlStore, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	// idle connections are kept, so their prepared statements
+	// don't have to be prepared again
+	db.SetMaxOpenConns(poolSize)
+	db.SetMaxIdleConns(poolSize)
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: dialect, stmts: make(map[string]*sql.Stmt), statusCodes: make(map[int]Status)}, nil
+}
+
+// Close the prepared statements and the database
+func (s *sqlStore) Close() error {
+	s.stmtMutex.Lock()
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+	s.stmtMutex.Unlock()
+	return s.db.Close()
+}
+
+// Rewrite the placeholders in a query for the database. A ?
+// in a quoted string or identifier is left alone.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	// the quote a string or identifier was opened with
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			// '' in a string closes and opens it again
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Get the prepared statement for a query, preparing it the
+// first time
+func (s *sqlStore) stmt(query string) (*sql.Stmt, error) {
+	s.stmtMutex.Lock()
+	defer s.stmtMutex.Unlock()
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(s.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		// the row reports the error when it's scanned
+		return s.db.QueryRow(s.rebind(query), args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+// Check whether the database has a table
+func (s *sqlStore) tableExists(table string) (bool, error) {
+	query := "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if s.dialect == dialectPostgres {
+		query = "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+	var count int
+	err := s.queryRow(query, table).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the store logs every query it's asked
+	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"no placeholders", "SELECT 1", "SELECT 1"},
+		{"placeholders", "UPDATE people SET name = ? WHERE username = ?", "UPDATE people SET name = $1 WHERE username = $2"},
+		{"more than nine", "VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", "VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"},
+		{"a ? in a string", "SELECT id FROM status WHERE value = '?' AND board = ?", "SELECT id FROM status WHERE value = '?' AND board = $1"},
+		{"an escaped quote in a string", "SELECT 'it''s ?', ?", "SELECT 'it''s ?', $1"},
+		{"a ? in an identifier", `SELECT "what?" FROM t WHERE a = ?`, `SELECT "what?" FROM t WHERE a = $1`},
+		{"a double quote in a string", `SELECT '"?' WHERE a = ?`, `SELECT '"?' WHERE a = $1`},
+	}
+	s := &sqlStore{dialect: dialectPostgres}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.rebind(tt.query); got != tt.want {
+				t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+	sqlite := &sqlStore{dialect: dialectSqlite}
+	if query := "SELECT ? WHERE a = '?'"; sqlite.rebind(query) != query {
+		t.Errorf("rebind changed %q for SQLite", query)
+	}
+}
+
+// Open a Postgres database for a test, in a schema of its own
+// that's dropped afterwards. The test is skipped unless
+// INOUTBOARD_TEST_POSTGRES_URL is set, eg: to
+// postgres://localhost/inoutboard_test?sslmode=disable
+func openPostgresTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	url := os.Getenv("INOUTBOARD_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("INOUTBOARD_TEST_POSTGRES_URL isn't set")
+	}
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("inoutboard_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+		if _, err = db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	s, err := newSqlStore(dialectPostgres, "postgres", url+separator+"search_path="+schema, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSqliteStore(t *testing.T) {
+	testStore(t, openTestStore(t))
+}
+
+func TestPostgresStore(t *testing.T) {
+	testStore(t, openPostgresTestStore(t))
+}
+
+// Migrate a new database, and add, change and remove people
+// and status codes in it
+func testStore(t *testing.T, s *sqlStore) {
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := s.MigrationStatus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("migrating again: %s", err)
+	}
+
+	// people
+	if _, err := s.AddPerson("amy", "Amy", "Sales", "101", "555 0101", "1A", "Manager", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddPerson("bob", "Bob", "Support", "", "", "", "", "north"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPersonDetails(&Person{Username: "bob", Name: "Bob Smith", Department: "Support", Board: "north"}); err != nil {
+		t.Fatal(err)
+	}
+	people, err := s.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].Username != "amy" || people[1].Name != "Bob Smith" {
+		t.Fatalf("people = %+v, want Amy and Bob Smith", people)
+	}
+
+	// statuses
+	codes, err := s.StatusCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 3 {
+		t.Fatalf("status codes = %v, want the 3 defaults", codes)
+	}
+	lunch, err := s.AddStatus("north", "Lunch?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetPerson(&Person{Username: "bob", Status: *lunch, Remarks: "back at 1"}, "amy"); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := s.GetPerson("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Status.Value != "Lunch?" || bob.Remarks != "back at 1" || bob.LastEditor != "Amy" || bob.Board != "north" {
+		t.Errorf("bob = %+v, want Lunch? on the north board, set by Amy", bob)
+	}
+	if err = s.RemoveStatus("north", lunch.Code); err != errStatusInUse {
+		t.Errorf("removing a status in use = %v, want %v", err, errStatusInUse)
+	}
+	if err = s.SetPerson(&Person{Username: "bob", Status: codes[1]}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveStatus("north", lunch.Code); err != nil {
+		t.Errorf("removing a status = %v", err)
+	}
+
+	// removing and restoring
+	if err = s.RemovePerson(bob); err != nil {
+		t.Fatal(err)
+	}
+	if people, err = s.GetUsers(); err != nil || len(people) != 1 {
+		t.Fatalf("after removing bob, people = %+v, %v", people, err)
+	}
+	if err = s.RestorePerson("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemovePerson(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PurgePerson("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetPerson("bob"); err == nil {
+		t.Errorf("bob is still there after being purged")
+	}
+}
+
+// A migrated database with a board of people in it
+func benchmarkStore(b *testing.B, people int) *sqlStore {
+	b.Helper()
+	s := openTestStore(b)
+	if err := s.Migrate(); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < people; i++ {
+		_, err := s.AddPerson(fmt.Sprintf("user%d", i), fmt.Sprintf("User %d", i), fmt.Sprintf("Department %d", i%10),
+			"555 0100", "555 0199", "101", "Staff", defaultBoard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+// A store on the same database as s, with prepared
+// statements of its own
+func storeOn(s *sqlStore) *sqlStore {
+	return &sqlStore{db: s.db, dialect: s.dialect, stmts: make(map[string]*sql.Stmt), statusCodes: make(map[int]Status)}
+}
+
+// Close and forget a store's prepared statements, so its next
+// query prepares its statement again, as every query did
+// before statements were kept
+func forgetStatements(s *sqlStore) {
+	s.stmtMutex.Lock()
+	defer s.stmtMutex.Unlock()
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+}
+
+// Run an operation on the store with its statements kept, as
+// they are, and prepared for every call, as they were, as the
+// "kept" and "per-call" sub-benchmarks
+func benchmarkStatements(b *testing.B, s *sqlStore, op func(s *sqlStore, i int) error) {
+	for _, perCall := range []bool{false, true} {
+		name := "kept"
+		if perCall {
+			name = "per-call"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := storeOn(s)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := op(s, i); err != nil {
+					b.Fatal(err)
+				}
+				if perCall {
+					forgetStatements(s)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetPerson(b *testing.B) {
+	benchmarkStatements(b, benchmarkStore(b, 200), func(s *sqlStore, i int) error {
+		_, err := s.GetPerson(fmt.Sprintf("user%d", i%200))
+		return err
+	})
+}
+
+func BenchmarkGetPersonParallel(b *testing.B) {
+	s := benchmarkStore(b, 200)
+	for _, perCall := range []bool{false, true} {
+		name := "kept"
+		if perCall {
+			name = "per-call"
+		}
+		b.Run(name, func(b *testing.B) {
+			shared := storeOn(s)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// statements closed after every call can't be
+				// shared between goroutines
+				s := shared
+				if perCall {
+					s = storeOn(shared)
+				}
+				for i := 0; pb.Next(); i++ {
+					if _, err := s.GetPerson(fmt.Sprintf("user%d", i%200)); err != nil {
+						b.Error(err)
+						return
+					}
+					if perCall {
+						forgetStatements(s)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkValidateSession(b *testing.B) {
+	s := benchmarkStore(b, 200)
+	for i := 0; i < 200; i++ {
+		if err := s.CreateSession(fmt.Sprintf("session%d", i), i+1, []string{RoleAdmin}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	benchmarkStatements(b, s, func(s *sqlStore, i int) error {
+		_, _, err := s.ValidateSession(fmt.Sprintf("session%d", i%200))
+		return err
+	})
+}
+
+func BenchmarkGetUsers(b *testing.B) {
+	benchmarkStatements(b, benchmarkStore(b, 200), func(s *sqlStore, i int) error {
+		people, err := s.GetUsers()
+		if err == nil && len(people) != 200 {
+			err = fmt.Errorf("got %d people, want 200", len(people))
+		}
+		return err
+	})
+}
+
+func BenchmarkSetPerson(b *testing.B) {
+	statuses := []Status{{Code: 1}, {Code: 2}, {Code: 3}}
+	benchmarkStatements(b, benchmarkStore(b, 200), func(s *sqlStore, i int) error {
+		person := &Person{Username: fmt.Sprintf("user%d", i%200), Status: statuses[i%3], Remarks: "back at 3"}
+		return s.SetPerson(person, "user0")
+	})
+}
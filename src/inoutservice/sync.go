@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ldap.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entries fetched per page when listing a directory
+const ldapPageSize = 500
+
+// What started a sync
+const (
+	syncTriggerCommand  = "command"
+	syncTriggerSchedule = "schedule"
+	syncTriggerManual   = "manual"
+)
+
+// only one sync runs at a time
+var syncMutex sync.Mutex
+
+// A record of one LDAP sync
+type SyncRun struct {
+	ID        int
+	Trigger   string
+	StartTime time.Time
+	EndTime   *time.Time
+	Added     int
+	Updated   int
+	Removed   int
+	Errors    int
+	// why the sync failed, if it did
+	Message string
+}
+
+// Update all the database users with attributes
+// from LDAP. Accordingly, this takes a set of
+// LDAP connection options as a parameter. This is
+// the --update-users command.
+func UpdateLdap(options AuthorizationOptions, mode syncMode) error {
+	_, err := runSync(options, syncTriggerCommand, mode, os.Stdout)
+	return err
+}
+
+// Run a sync and record it in the database. Progress
+// is written to the progress writer. It fails if another
+// sync is already running.
+func runSync(options AuthorizationOptions, trigger string, mode syncMode, progress io.Writer) (*SyncRun, error) {
+	run, err := beginSync(trigger)
+	if err != nil {
+		return nil, err
+	}
+	return run, finishSync(options, run, mode, progress)
+}
+
+// Take the sync lock and record the start of a sync, which
+// finishSync runs. It fails if another sync is already
+// running.
+func beginSync(trigger string) (*SyncRun, error) {
+	if !syncMutex.TryLock() {
+		return nil, errSyncRunning
+	}
+	run := &SyncRun{Trigger: trigger, StartTime: time.Now()}
+	if err := store.CreateSyncRun(run); err != nil {
+		log.Errorf("Could not record the start of a sync: %s", err)
+	}
+	return run, nil
+}
+
+// Run a sync begun by beginSync, record how it went and
+// let the next sync run
+func finishSync(options AuthorizationOptions, run *SyncRun, mode syncMode, progress io.Writer) error {
+	defer syncMutex.Unlock()
+
+	err := syncLdap(options, run, mode, progress)
+	if err != nil {
+		run.Message = err.Error()
+	}
+	end := time.Now()
+	run.EndTime = &end
+	if err := store.FinishSyncRun(run); err != nil {
+		log.Errorf("Could not record the end of a sync: %s", err)
+	}
+	log.Infof("LDAP sync finished: %d added, %d updated, %d removed, %d errors",
+		run.Added, run.Updated, run.Removed, run.Errors)
+	return err
+}
+
+// returned when a sync is asked for while one is running
+var errSyncRunning = errors.New("a sync is already running")
+
+// Run a sync every interval, until the program exits
+func scheduleSync(options AuthorizationOptions, interval time.Duration) {
+	log.Infof("Syncing with LDAP every %s", interval)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if _, err := runSync(options, syncTriggerSchedule, syncMode{}, ioutil.Discard); err != nil {
+			log.Errorf("Scheduled LDAP sync failed: %s", err)
+		}
+	}
+}
+
+// Update the people in the database from LDAP, counting
+// what changed in the run. Nothing is changed if the LDAP
+// server becomes unavailable while working out what to do,
+// or if more would change than the safety limits allow
+// and the sync isn't forced. Where each directory got to
+// is saved for the next sync.
+func syncLdap(options AuthorizationOptions, run *SyncRun, mode syncMode, progress io.Writer) error {
+	plan, err := planSync(options, mode.full)
+	if err != nil {
+		return err
+	}
+	if err = syncSafety.check(plan); err != nil {
+		if !mode.force {
+			log.Errorf("LDAP sync aborted: %s. Check the LDAP bind account and search base, or force the sync.", err)
+			return err
+		}
+		log.Warnf("Forcing LDAP sync past the safety limits: %s", err)
+	}
+	failed := applySync(plan, run, progress)
+	for _, cursor := range plan.cursors {
+		if failed[cursor.Directory] || failed[""] {
+			// the next sync reads the changes again
+			log.Warnf("Not saving the sync cursor for %s, as some of the changes from it failed", cursor.Directory)
+			continue
+		}
+		if err = store.SaveSyncCursor(cursor); err != nil {
+			log.Errorf("Could not save the sync cursor for %s: %s", cursor.Directory, err)
+		}
+	}
+	return nil
+}
+
+// Default safety limits
+const defaultMaxRemovalPercent = 25
+
+// The percentage limits only apply when more people than
+// this are checked, so that one leaver from a tiny board
+// doesn't stop its syncs
+const minPercentLimitPeople = 5
+
+// Limits on how much one sync may change, to protect the
+// board from a broken LDAP search. Zero means no limit.
+type syncLimits struct {
+	maxRemovals       int
+	maxRemovalPercent int
+	maxChanges        int
+	maxChangePercent  int
+}
+
+// the safety limits for syncs, set from the config file
+var syncSafety = syncLimits{maxRemovalPercent: defaultMaxRemovalPercent}
+
+// Get the safety limits from the config file
+func syncLimitsFromConfig(cfg *Config) syncLimits {
+	limits := syncLimits{
+		maxRemovals:       cfg.Sync.MaxRemovals,
+		maxRemovalPercent: cfg.Sync.MaxRemovalPercent,
+		maxChanges:        cfg.Sync.MaxChanges,
+		maxChangePercent:  cfg.Sync.MaxChangePercent,
+	}
+	if limits.maxRemovalPercent == 0 {
+		limits.maxRemovalPercent = defaultMaxRemovalPercent
+	}
+	return limits
+}
+
+// returned when a sync would change too much
+var errSyncUnsafe = errors.New("sync exceeds the safety limits")
+
+// Check a plan against the limits. Changes are removals
+// plus updates; percentages are of the people checked, and
+// only apply when more than minPercentLimitPeople people are
+// checked. Removing everyone checked is never allowed by the
+// removal percentage, however few people there are.
+func (limits syncLimits) check(plan *SyncPlan) error {
+	removals := len(plan.Remove)
+	changes := removals + len(plan.Update)
+	percent := func(n int) int {
+		if plan.Checked <= minPercentLimitPeople {
+			return 0
+		}
+		return n * 100 / plan.Checked
+	}
+
+	switch {
+	case limits.maxRemovals > 0 && removals > limits.maxRemovals:
+		return fmt.Errorf("%w: %d people would be removed, more than %d", errSyncUnsafe, removals, limits.maxRemovals)
+	case limits.maxRemovalPercent > 0 && removals > 0 && removals >= plan.Checked:
+		return fmt.Errorf("%w: all %d people checked would be removed", errSyncUnsafe, plan.Checked)
+	case limits.maxRemovalPercent > 0 && percent(removals) > limits.maxRemovalPercent:
+		return fmt.Errorf("%w: %d of %d people would be removed, more than %d%%", errSyncUnsafe, removals, plan.Checked, limits.maxRemovalPercent)
+	case limits.maxChanges > 0 && changes > limits.maxChanges:
+		return fmt.Errorf("%w: %d people would be removed or changed, more than %d", errSyncUnsafe, changes, limits.maxChanges)
+	case limits.maxChangePercent > 0 && percent(changes) > limits.maxChangePercent:
+		return fmt.Errorf("%w: %d of %d people would be removed or changed, more than %d%%", errSyncUnsafe, changes, plan.Checked, limits.maxChangePercent)
+	}
+	return nil
+}
+
+// Make the changes in a sync plan, returning the directories
+// that some of the changes for failed. "" is among them if
+// it isn't known which directory a failed change was for.
+func applySync(plan *SyncPlan, run *SyncRun, progress io.Writer) map[string]bool {
+	run.Errors += len(plan.Errors)
+	failed := make(map[string]bool)
+
+	for _, removal := range plan.Remove {
+		log.Infof("Removing previous employee %s (%s)", removal.Username, removal.Reason)
+		if err := store.RemovePerson(removal.person); err != nil {
+			log.Printf("Failed to remove user %s: %s", removal.Username, err)
+			run.Errors++
+			failed[plan.directories[strings.ToLower(removal.Username)]] = true
+			continue
+		}
+		run.Removed++
+		fmt.Fprintf(progress, "- ")
+	}
+
+	for _, update := range plan.Update {
+		user := update.person
+		log.Debugf("updating %s with name = %s, department = %s, office = %s telephone = %s, mobile = %s, title = %s",
+			user.Username,
+			user.Name,
+			user.Department,
+			user.Office,
+			user.Telephone,
+			user.Mobile,
+			user.Title)
+		if err := store.SetPersonDetails(user); err != nil {
+			log.Printf("Failed to update user %s: %s", user.Username, err)
+			run.Errors++
+			failed[plan.directories[strings.ToLower(user.Username)]] = true
+			continue
+		}
+		run.Updated++
+		fmt.Fprintf(progress, ". ")
+	}
+
+	for _, person := range plan.Add {
+		if _, err := addLdapUser(person); err != nil {
+			log.Printf("Failed to add user %s: %s", person.Username, err)
+			run.Errors++
+			failed[plan.directories[strings.ToLower(person.Username)]] = true
+			continue
+		}
+		run.Added++
+		fmt.Fprintf(progress, "+ ")
+	}
+	fmt.Fprintf(progress, "\n")
+	return failed
+}
+
+// Show the history of LDAP syncs, or start one. A sync
+// started with ?force=true skips the safety limits, and
+// one started with ?full=true reads everyone.
+func syncHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS, HEAD")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET":
+		runs, err := store.GetSyncRuns(50)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = json.NewEncoder(w).Encode(runs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "POST":
+		mode := syncMode{
+			force: r.URL.Query().Get("force") == "true",
+			full:  r.URL.Query().Get("full") == "true",
+		}
+		// the lock is held from here until the sync finishes
+		run, err := beginSync(syncTriggerManual)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Infof("%s started LDAP sync %d (force = %t, full = %t)", usernameFromContext(r.Context()), run.ID, mode.force, mode.full)
+		started := *run
+		go func(options AuthorizationOptions) {
+			if err := finishSync(options, run, mode, ioutil.Discard); err != nil {
+				log.Errorf("LDAP sync failed: %s", err)
+			}
+		}(*authOptions)
+		w.WriteHeader(http.StatusAccepted)
+		if err = json.NewEncoder(w).Encode(&started); err != nil {
+			log.Errorf("Could not send the sync run: %s", err)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// whether a directory has a filter or group for
+// adding people to the board
+func (d *directory) provisions() bool {
+	return d.provisionFilter != "" || len(d.provisionGroups) > 0
+}
+
+// The filter for everyone in a directory who should
+// be on the board
+func provisionFilter(d *directory) string {
+	filter := fmt.Sprintf("(objectClass=%s)", d.userObjectClass)
+	filter += d.provisionFilter
+	if len(d.provisionGroups) > 0 {
+		groups := ""
+		for _, group := range d.provisionGroups {
+			groups += fmt.Sprintf("(memberOf=%s)", ldap.EscapeFilter(group))
+		}
+		filter += "(|" + groups + ")"
+	}
+	return "(&" + filter + ")"
+}
+
+// A directory's users, fetched in bulk for a sync
+type directoryListing struct {
+	d *directory
+	// every user, by lower-case username. For an incremental
+	// sync, only the users who have changed.
+	users map[string]*ldap.Entry
+	// usernames held by more than one entry
+	duplicates map[string]bool
+	// the users who should be on the board
+	provisioned []*ldap.Entry
+	incremental bool
+	// where the next sync can start from, if anywhere
+	cursor *SyncCursor
+}
+
+// Fetch all of a directory's users, and those who should be on
+// the board, with paged searches on one bound connection. With
+// a cursor, only the users who changed since it are fetched,
+// unless the cursor came from a different server.
+func listDirectory(d *directory, cursor *SyncCursor, mappings map[string]fieldMapping) (*directoryListing, error) {
+	attributes := userAttributes(d, mappings)
+	if d.changeAttribute != "" {
+		attributes = append(attributes, d.changeAttribute)
+	}
+	var listing *directoryListing
+	err := d.pool.do(func(conn *ldap.Conn) error {
+		listing = &directoryListing{
+			d:          d,
+			users:      make(map[string]*ldap.Entry),
+			duplicates: make(map[string]bool),
+		}
+		var server string
+		if d.changeAttribute != "" {
+			server = serverName(conn)
+			listing.cursor = &SyncCursor{Directory: d.name, Attribute: d.changeAttribute, Server: server, FullSyncTime: time.Now()}
+		}
+		if cursor != nil && cursor.Server == server {
+			listing.incremental = true
+			listing.cursor.Value = cursor.Value
+			listing.cursor.FullSyncTime = cursor.FullSyncTime
+		} else if cursor != nil {
+			log.Infof("Last sync of %s was with %q, not %q; reading everyone", d.name, cursor.Server, server)
+		}
+
+		search := func(filter string) ([]*ldap.Entry, error) {
+			if listing.incremental {
+				filter = changedSince(filter, cursor)
+			}
+			res, err := conn.SearchWithPaging(ldap.NewSearchRequest(
+				d.ldapSearchBase,
+				ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+				filter,
+				attributes,
+				nil,
+			), ldapPageSize)
+			if err != nil {
+				return nil, err
+			}
+			if listing.cursor != nil {
+				for _, entry := range res.Entries {
+					if value := entry.GetAttributeValue(d.changeAttribute); laterChange(d.changeAttribute, value, listing.cursor.Value) {
+						listing.cursor.Value = value
+					}
+				}
+			}
+			return res.Entries, nil
+		}
+
+		entries, err := search(userFilter(d, "*"))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			username := strings.ToLower(d.canonicalUsername(entry.GetAttributeValue(d.usernameAttribute)))
+			if username == "" {
+				continue
+			}
+			if _, ok := listing.users[username]; ok {
+				listing.duplicates[username] = true
+			}
+			listing.users[username] = entry
+		}
+
+		if !d.provisions() {
+			return nil
+		}
+		listing.provisioned, err = search(provisionFilter(d))
+		return err
+	})
+	if err != nil {
+		log.Errorf("Listing the users in %s failed: %s", d.name, err)
+		return nil, err
+	}
+	if listing.incremental {
+		log.Infof("Found %d users changed in %s since %s, %d of whom should be on the board",
+			len(listing.users), d.name, cursor.Value, len(listing.provisioned))
+	} else {
+		log.Infof("Found %d users in %s, %d of whom should be on the board", len(listing.users), d.name, len(listing.provisioned))
+	}
+	return listing, nil
+}
+
+// Find a person in the directory listings. Anyone whose username
+// isn't the one the listings are keyed by, eg: a user stored
+// as DOMAIN\user, is looked up on their own. If every listing
+// is incremental, anyone not in them hasn't changed, and nil
+// is returned with errUnchanged.
+func matchUser(options *AuthorizationOptions, listings []*directoryListing, username string) (*Person, string, error) {
+	key := strings.ToLower(username)
+	var found *Person
+	var foundIn *directory
+	for _, listing := range listings {
+		if listing.duplicates[key] {
+			log.Errorf("Got more than one entry for %s in %s", username, listing.d.name)
+			return nil, listing.d.name, errors.New("Got too many results for LDAP query")
+		}
+		entry, ok := listing.users[key]
+		if !ok {
+			continue
+		}
+		if found != nil {
+			log.Errorf("%s was found in both the %s and %s directories", username, foundIn.name, listing.d.name)
+			return nil, "", fmt.Errorf("%s is ambiguous; use DOMAIN\\user or a UPN", username)
+		}
+		found, foundIn = options.personFromEntry(listing.d, entry), listing.d
+	}
+	if found != nil {
+		return found, foundIn.name, nil
+	}
+	for _, listing := range listings {
+		if !listing.incremental {
+			person, err := options.findUser(username)
+			return person, options.directoryOf(username), err
+		}
+	}
+	return nil, "", errUnchanged
+}
+
+// the name of the directory a username is in, or "" if it
+// could be in more than one
+func (o *AuthorizationOptions) directoryOf(username string) string {
+	if dirs, _ := o.directoriesFor(username); len(dirs) == 1 {
+		return dirs[0].name
+	}
+	return ""
+}
+
+// returned for people whose LDAP entries haven't changed
+var errUnchanged = errors.New("unchanged since the last sync")
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSyncLimitsCheck(t *testing.T) {
+	plan := func(checked, removals, updates int) *SyncPlan {
+		return &SyncPlan{
+			Checked: checked,
+			Remove:  make([]*PersonRemoval, removals),
+			Update:  make([]*PersonUpdate, updates),
+		}
+	}
+	defaults := syncLimits{maxRemovalPercent: defaultMaxRemovalPercent}
+	tests := []struct {
+		name   string
+		limits syncLimits
+		plan   *SyncPlan
+		unsafe bool
+	}{
+		{"nothing to do", defaults, plan(100, 0, 0), false},
+		{"nobody checked", defaults, plan(0, 0, 0), false},
+		{"removals within the percentage", defaults, plan(100, 25, 0), false},
+		{"removals over the percentage", defaults, plan(100, 26, 0), true},
+		{"two leavers from a small board", defaults, plan(8, 2, 0), false},
+		{"most of a small board", defaults, plan(8, 5, 0), true},
+		{"one leaver from a tiny board", defaults, plan(3, 1, 0), false},
+		{"most of a tiny board", defaults, plan(5, 4, 0), false},
+		{"everyone from a tiny board", defaults, plan(3, 3, 0), true},
+		{"the only person on a board", defaults, plan(1, 1, 0), true},
+		{"everyone from a large board", defaults, plan(100, 100, 0), true},
+		{"updates don't count as removals", defaults, plan(100, 0, 90), false},
+		{"no limits", syncLimits{}, plan(100, 100, 0), false},
+		{"removals within the count", syncLimits{maxRemovals: 3}, plan(100, 3, 0), false},
+		{"removals over the count", syncLimits{maxRemovals: 3}, plan(100, 4, 0), true},
+		{"the count applies to small boards", syncLimits{maxRemovals: 1}, plan(4, 2, 0), true},
+		{"changes within the count", syncLimits{maxChanges: 10}, plan(100, 4, 6), false},
+		{"changes over the count", syncLimits{maxChanges: 10}, plan(100, 4, 7), true},
+		{"changes within the percentage", syncLimits{maxChangePercent: 10}, plan(100, 5, 5), false},
+		{"changes over the percentage", syncLimits{maxChangePercent: 10}, plan(100, 5, 6), true},
+		{"changes on a tiny board", syncLimits{maxChangePercent: 10}, plan(5, 2, 3), false},
+		{"changes on a small board", syncLimits{maxChangePercent: 10}, plan(10, 2, 3), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.check(tt.plan)
+			if (err != nil) != tt.unsafe {
+				t.Fatalf("check(%d checked, %d removed, %d updated) = %v, want unsafe %v",
+					tt.plan.Checked, len(tt.plan.Remove), len(tt.plan.Update), err, tt.unsafe)
+			}
+			if err != nil && !errors.Is(err, errSyncUnsafe) {
+				t.Errorf("check returned %v, which isn't errSyncUnsafe", err)
+			}
+		})
+	}
+}
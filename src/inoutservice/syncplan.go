@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The changes a sync would make to the board
+type SyncPlan struct {
+	Add    []*Person
+	Update []*PersonUpdate
+	Remove []*PersonRemoval
+	// people who couldn't be looked up, and are left alone
+	Errors []*SyncError
+	// how many people on the board were checked
+	Checked int
+	// why the sync would be stopped by the safety limits, if it would
+	Unsafe string `json:",omitempty"`
+	// the directories only changed entries were read from
+	Incremental []string
+	// where each directory got to
+	cursors []*SyncCursor
+	// the directory each person added, updated or removed
+	// is in, by lower-case username
+	directories map[string]string
+}
+
+// A change to one of a person's fields
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// The changes to one person's details
+type PersonUpdate struct {
+	Username string
+	Changes  []FieldChange
+	// the person with the changes made
+	person *Person
+}
+
+// A person who would be taken off the board, and why
+type PersonRemoval struct {
+	Username string
+	Name     string
+	Reason   string
+	person   *Person
+}
+
+// A person who couldn't be looked up in LDAP
+type SyncError struct {
+	Username string
+	Error    string
+}
+
+// Work out what a sync would change, without changing
+// anything. Each directory is read in bulk and matched with
+// the board in memory. Unless full is set, only entries
+// changed since the last sync are read from directories
+// that track changes. This stops if the LDAP server
+// becomes unavailable.
+func planSync(options AuthorizationOptions, full bool) (*SyncPlan, error) {
+	plan := &SyncPlan{
+		Add:         make([]*Person, 0),
+		Update:      make([]*PersonUpdate, 0),
+		Remove:      make([]*PersonRemoval, 0),
+		Errors:      make([]*SyncError, 0),
+		Incremental: make([]string, 0),
+		directories: make(map[string]string),
+	}
+
+	// get users
+	people, err := store.GetUsers()
+	if err != nil {
+		log.Errorf("Failed to get users from the database: %s", err.Error())
+		return nil, err
+	}
+	listings := make([]*directoryListing, 0, len(options.directories))
+	for _, d := range options.directories {
+		listing, err := listDirectory(d, cursorFor(d, full), options.attributes)
+		if err != nil {
+			return nil, err
+		}
+		listings = append(listings, listing)
+		if listing.incremental {
+			plan.Incremental = append(plan.Incremental, d.name)
+		}
+		if listing.cursor != nil {
+			plan.cursors = append(plan.cursors, listing.cursor)
+		}
+	}
+
+	known := make(map[string]bool)
+	// for each user, get the LDAP entry
+	for _, user := range people {
+		known[strings.ToLower(user.Username)] = true
+		plan.Checked++
+		updated, directory, err := matchUser(&options, listings, user.Username)
+		if errors.Is(err, ErrLdapUnavailable) {
+			return nil, err
+		}
+		if err == errUnchanged {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to get user %s from the LDAP Server: %s", user.Username, err.Error())
+			plan.Errors = append(plan.Errors, &SyncError{Username: user.Username, Error: err.Error()})
+			continue
+		}
+		plan.directories[strings.ToLower(user.Username)] = directory
+		if updated == nil && user.IsLocal {
+			// added by hand, so not expected to be in LDAP
+			continue
+		}
+		if updated == nil {
+			plan.Remove = append(plan.Remove, &PersonRemoval{Username: user.Username, Name: user.Name, Reason: "not found in LDAP", person: user})
+			continue
+		}
+		if updated.IsDeleted {
+			plan.Remove = append(plan.Remove, &PersonRemoval{Username: user.Username, Name: user.Name, Reason: "disabled in LDAP", person: user})
+			continue
+		}
+		if update := diffPerson(user, updated); update != nil {
+			plan.Update = append(plan.Update, update)
+		}
+	}
+
+	// add anyone who should be on the board but isn't
+	for _, listing := range listings {
+		for _, entry := range listing.provisioned {
+			person := options.personFromEntry(listing.d, entry)
+			if person.Username == "" || person.IsDeleted || known[strings.ToLower(person.Username)] {
+				continue
+			}
+			known[strings.ToLower(person.Username)] = true
+			plan.directories[strings.ToLower(person.Username)] = listing.d.name
+			plan.Add = append(plan.Add, person)
+		}
+	}
+	if err = syncSafety.check(plan); err != nil {
+		plan.Unsafe = err.Error()
+	}
+	return plan, nil
+}
+
+// Compare a person on the board with their LDAP entry,
+// returning nil if nothing has changed. The board is only
+// compared if the entry has one.
+func diffPerson(user *Person, updated *Person) *PersonUpdate {
+	changed := *user
+	update := &PersonUpdate{Username: user.Username, person: &changed}
+	fields := []struct {
+		name string
+		old  *string
+		new  string
+	}{
+		{fieldName, &changed.Name, updated.Name},
+		{fieldDepartment, &changed.Department, updated.Department},
+		{fieldOffice, &changed.Office, updated.Office},
+		{fieldTelephone, &changed.Telephone, updated.Telephone},
+		{fieldMobile, &changed.Mobile, updated.Mobile},
+		{fieldTitle, &changed.Title, updated.Title},
+		{fieldBoard, &changed.Board, updated.Board},
+	}
+	for _, field := range fields {
+		if field.name == fieldBoard && field.new == "" {
+			continue
+		}
+		if *field.old != field.new {
+			update.Changes = append(update.Changes, FieldChange{Field: field.name, Old: *field.old, New: field.new})
+			*field.old = field.new
+		}
+	}
+	if len(update.Changes) == 0 {
+		return nil
+	}
+	return update
+}
+
+// Write a plan in a form people can read
+func (plan *SyncPlan) WriteText(w io.Writer) {
+	if len(plan.Incremental) > 0 {
+		fmt.Fprintf(w, "Only changes since the last sync were read from: %s\n", strings.Join(plan.Incremental, ", "))
+	}
+	fmt.Fprintf(w, "Add (%d):\n", len(plan.Add))
+	for _, person := range plan.Add {
+		fmt.Fprintf(w, "  + %s (%s, %s)\n", person.Username, person.Name, person.Department)
+	}
+	fmt.Fprintf(w, "Update (%d):\n", len(plan.Update))
+	for _, update := range plan.Update {
+		fmt.Fprintf(w, "  ~ %s\n", update.Username)
+		for _, change := range update.Changes {
+			fmt.Fprintf(w, "      %s: %q -> %q\n", change.Field, change.Old, change.New)
+		}
+	}
+	fmt.Fprintf(w, "Remove (%d):\n", len(plan.Remove))
+	for _, removal := range plan.Remove {
+		fmt.Fprintf(w, "  - %s (%s): %s\n", removal.Username, removal.Name, removal.Reason)
+	}
+	fmt.Fprintf(w, "Errors (%d):\n", len(plan.Errors))
+	for _, syncErr := range plan.Errors {
+		fmt.Fprintf(w, "  ! %s: %s\n", syncErr.Username, syncErr.Error)
+	}
+	if plan.Unsafe != "" {
+		fmt.Fprintf(w, "\nThis sync would be stopped: %s. Use --force to run it anyway.\n", plan.Unsafe)
+	}
+}
+
+// Write a plan as JSON
+func (plan *SyncPlan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+// This is the --update-users --dry-run command
+func DryRunLdap(options AuthorizationOptions, full bool, asJSON bool, out io.Writer) error {
+	plan, err := planSync(options, full)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return plan.WriteJSON(out)
+	}
+	plan.WriteText(out)
+	return nil
+}
+
+// Show what a sync would change, as JSON, or as text
+// with ?format=text. With ?full=true, everyone is read.
+func syncPlanHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, OPTIONS, HEAD")
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET":
+		plan, err := planSync(*authOptions, r.URL.Query().Get("full") == "true")
+		if errors.Is(err, ErrLdapUnavailable) {
+			ldapUnavailable(w)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			plan.WriteText(w)
+			return
+		}
+		if err = plan.WriteJSON(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
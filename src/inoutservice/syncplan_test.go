@@ -0,0 +1,137 @@
+package main
+
+import (
+	"gopkg.in/ldap.v2"
+	"reflect"
+	"testing"
+)
+
+func TestDiffPerson(t *testing.T) {
+	user := &Person{
+		ID:         7,
+		Username:   "bob",
+		Name:       "Bob Smith",
+		Department: "Sales",
+		Office:     "101",
+		Telephone:  "555 1234",
+		Mobile:     "555 9876",
+		Title:      "Manager",
+		Status:     Status{Code: 2, Value: "Out"},
+		Remarks:    "back at 3",
+	}
+	tests := []struct {
+		name    string
+		updated Person
+		want    []FieldChange
+	}{
+		{"nothing changed", Person{Name: "Bob Smith", Department: "Sales", Office: "101",
+			Telephone: "555 1234", Mobile: "555 9876", Title: "Manager"}, nil},
+		{"one field", Person{Name: "Bob Smith", Department: "Support", Office: "101",
+			Telephone: "555 1234", Mobile: "555 9876", Title: "Manager"},
+			[]FieldChange{{fieldDepartment, "Sales", "Support"}}},
+		{"fields in order", Person{Name: "Robert Smith", Department: "Sales", Office: "202",
+			Telephone: "555 1234", Mobile: "", Title: "Director"},
+			[]FieldChange{{fieldName, "Bob Smith", "Robert Smith"}, {fieldOffice, "101", "202"},
+				{fieldMobile, "555 9876", ""}, {fieldTitle, "Manager", "Director"}}},
+		{"case matters", Person{Name: "Bob smith", Department: "Sales", Office: "101",
+			Telephone: "555 1234", Mobile: "555 9876", Title: "Manager"},
+			[]FieldChange{{fieldName, "Bob Smith", "Bob smith"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := *user
+			update := diffPerson(user, &tt.updated)
+			if !reflect.DeepEqual(*user, before) {
+				t.Fatalf("diffPerson changed the person on the board: %+v", user)
+			}
+			if tt.want == nil {
+				if update != nil {
+					t.Fatalf("diffPerson = %+v, want nil", update.Changes)
+				}
+				return
+			}
+			if update == nil {
+				t.Fatalf("diffPerson = nil, want %+v", tt.want)
+			}
+			if !reflect.DeepEqual(update.Changes, tt.want) {
+				t.Errorf("diffPerson changes = %+v, want %+v", update.Changes, tt.want)
+			}
+			if update.Username != user.Username {
+				t.Errorf("diffPerson username = %q, want %q", update.Username, user.Username)
+			}
+			// the updated person keeps everything LDAP doesn't have
+			changed := update.person
+			if changed.ID != user.ID || changed.Status != user.Status || changed.Remarks != user.Remarks {
+				t.Errorf("diffPerson lost the person's own details: %+v", changed)
+			}
+			if changed.Name != tt.updated.Name || changed.Department != tt.updated.Department ||
+				changed.Office != tt.updated.Office || changed.Title != tt.updated.Title {
+				t.Errorf("diffPerson person = %+v, want the fields from %+v", changed, tt.updated)
+			}
+		})
+	}
+}
+
+func TestDiffPersonBoard(t *testing.T) {
+	tests := []struct {
+		name    string
+		board   string
+		updated string
+		want    []FieldChange
+	}{
+		{"LDAP doesn't say", "north", "", nil},
+		{"the same board", "north", "north", nil},
+		{"another board", "north", "south", []FieldChange{{fieldBoard, "north", "south"}}},
+		{"back to the default", "north", defaultBoard, []FieldChange{{fieldBoard, "north", defaultBoard}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &Person{Username: "bob", Name: "Bob Smith", Board: tt.board}
+			update := diffPerson(user, &Person{Name: "Bob Smith", Board: tt.updated})
+			var got []FieldChange
+			if update != nil {
+				got = update.Changes
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffPerson changes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersonFromEntryBoard(t *testing.T) {
+	previousBoards := boards
+	t.Cleanup(func() { boards = previousBoards })
+	boards = boardSettings{
+		list:   []*Board{{Name: defaultBoard}, {Name: "north"}},
+		values: map[string]string{defaultBoard: defaultBoard, "north": "north", "leeds": "north"},
+	}
+	d := &directory{name: "example", usernameAttribute: "sAMAccountName"}
+	entry := ldap.NewEntry("CN=Bob,DC=example,DC=com", map[string][]string{
+		"sAMAccountName": {"bob"},
+		"l":              {"Leeds"},
+	})
+	tests := []struct {
+		name  string
+		board []string
+		want  string
+	}{
+		{"no Board attribute", nil, ""},
+		{"a Board attribute", []string{"l"}, "north"},
+		{"a Board attribute the entry doesn't have", []string{"physicalDeliveryOfficeName"}, defaultBoard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.LdapAttributes.Board = tt.board
+			attributes, err := parseAttributeMappings(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := &AuthorizationOptions{attributes: attributes}
+			if got := options.personFromEntry(d, entry).Board; got != tt.want {
+				t.Errorf("board = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
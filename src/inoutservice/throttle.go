@@ -0,0 +1,294 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default login throttling settings, used when the
+// [Login] section of the config file doesn't set them
+const (
+	defaultMaxFailures      = 5
+	defaultIPMaxFailures    = 20
+	defaultLockoutMinutes   = 15
+	defaultBaseDelaySeconds = 1
+	defaultMaxDelaySeconds  = 60
+)
+
+// kinds of keys login attempts are tracked by
+const (
+	attemptsByUsername = "username"
+	attemptsByIP       = "ip"
+)
+
+// the login throttle, if one has been configured
+var loginLimiter *loginThrottle
+
+// Failed login attempts for a username or an address
+type loginAttempts struct {
+	Kind        string
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Tracks failed logins by username and by client address,
+// slowing down repeated failures with an exponential
+// backoff, and locking out a username or address for a while
+// after too many of them.
+type loginThrottle struct {
+	maxFailures   int
+	ipMaxFailures int
+	lockout       time.Duration
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	persist       bool
+
+	mutex     sync.Mutex
+	attempts  map[string]*loginAttempts
+	lastPrune time.Time
+	// the time now; replaced in tests
+	now func() time.Time
+}
+
+// Create a login throttle from the config file. Previously
+// saved attempts are loaded from the database if
+// persistence is turned on.
+func newLoginThrottle(cfg *Config) *loginThrottle {
+	t := &loginThrottle{
+		maxFailures:   cfg.Login.MaxFailures,
+		ipMaxFailures: cfg.Login.IPMaxFailures,
+		lockout:       time.Duration(cfg.Login.LockoutMinutes) * time.Minute,
+		baseDelay:     time.Duration(cfg.Login.BaseDelaySeconds) * time.Second,
+		maxDelay:      time.Duration(cfg.Login.MaxDelaySeconds) * time.Second,
+		persist:       cfg.Login.PersistAttempts,
+		attempts:      make(map[string]*loginAttempts),
+		lastPrune:     time.Now(),
+		now:           time.Now,
+	}
+	if t.maxFailures <= 0 {
+		t.maxFailures = defaultMaxFailures
+	}
+	if t.ipMaxFailures <= 0 {
+		t.ipMaxFailures = defaultIPMaxFailures
+	}
+	if t.lockout <= 0 {
+		t.lockout = defaultLockoutMinutes * time.Minute
+	}
+	if t.baseDelay <= 0 {
+		t.baseDelay = defaultBaseDelaySeconds * time.Second
+	}
+	if t.maxDelay <= 0 {
+		t.maxDelay = defaultMaxDelaySeconds * time.Second
+	}
+
+	if t.persist {
+		saved, err := store.GetLoginAttempts()
+		if err != nil {
+			log.Errorf("Could not load saved login attempts: %s", err)
+		}
+		for _, a := range saved {
+			t.attempts[a.Kind+":"+a.Key] = a
+		}
+	}
+	return t
+}
+
+// the address of the client making a request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// The keys a username's attempts are tracked by: one for
+// each directory it could be in, of the directory's name and
+// the name the user is looked up by there, without a UPN
+// suffix, in lower case. DOMAIN\user, user@suffix and USER
+// count against the same user, but the same name in another
+// directory is someone else. A bare username that could be in
+// more than one directory counts against each of them.
+func throttleKeys(username string) []string {
+	dirs, name := authOptions.directoriesFor(username)
+	if at := strings.LastIndex(name, "@"); at > 0 {
+		name = name[:at]
+	}
+	name = strings.ToLower(name)
+	if len(dirs) == 0 {
+		// not in a known directory, but still throttled
+		return []string{strings.ToLower(username)}
+	}
+	keys := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		keys = append(keys, strings.ToLower(d.name)+"\\"+name)
+	}
+	return keys
+}
+
+// A login attempt that has been counted as a failure until
+// it's known how it went
+type pendingLogin struct {
+	// the keys the username is tracked by
+	usernames []string
+	ip        string
+	at        time.Time
+	// the last failure of each key before this attempt
+	lastFailure map[string]time.Time
+}
+
+// Check whether a client may try to log in as a user now.
+// If it may, the attempt is counted as a failure straight
+// away, so that attempts made in parallel can't get past
+// the limits; success or abandon takes it back. Otherwise
+// returns how long the client must wait.
+func (t *loginThrottle) begin(username string, ip string) (*pendingLogin, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	t.prune(now)
+
+	keys := throttleKeys(username)
+	wait := t.wait(t.attempts[attemptsByIP+":"+ip], now)
+	for _, key := range keys {
+		if keyWait := t.wait(t.attempts[attemptsByUsername+":"+key], now); keyWait > wait {
+			wait = keyWait
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+	p := &pendingLogin{usernames: keys, ip: ip, at: now, lastFailure: make(map[string]time.Time)}
+	for _, key := range keys {
+		p.lastFailure[attemptsByUsername+":"+key] = t.fail(attemptsByUsername, key, t.maxFailures, now)
+	}
+	p.lastFailure[attemptsByIP+":"+ip] = t.fail(attemptsByIP, ip, t.ipMaxFailures, now)
+	return p, 0
+}
+
+// how long to wait for one set of attempts
+func (t *loginThrottle) wait(a *loginAttempts, now time.Time) time.Duration {
+	if a == nil || a.Failures == 0 {
+		return 0
+	}
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	delay := time.Duration(float64(t.baseDelay) * math.Pow(2, float64(a.Failures-1)))
+	if delay > t.maxDelay || delay <= 0 {
+		delay = t.maxDelay
+	}
+	if next := a.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Count a failure, returning when the last one was
+func (t *loginThrottle) fail(kind string, key string, max int, now time.Time) time.Time {
+	a, ok := t.attempts[kind+":"+key]
+	if !ok || (!a.LockedUntil.IsZero() && now.After(a.LockedUntil)) {
+		// a lockout that has run out starts the count again
+		a = &loginAttempts{Kind: kind, Key: key}
+		t.attempts[kind+":"+key] = a
+	}
+	last := a.LastFailure
+	a.Failures++
+	a.LastFailure = now
+	if a.Failures >= max && a.LockedUntil.IsZero() {
+		a.LockedUntil = now.Add(t.lockout)
+		log.Warnf("Locked out %s %s for %s after %d failed logins", kind, key, t.lockout, a.Failures)
+	}
+	t.save(a)
+	return last
+}
+
+// Take back a failure counted for a pending login
+func (t *loginThrottle) unfail(p *pendingLogin, kind string, key string, max int) {
+	a, ok := t.attempts[kind+":"+key]
+	if !ok || a.Failures == 0 {
+		return
+	}
+	a.Failures--
+	if a.LastFailure.Equal(p.at) {
+		a.LastFailure = p.lastFailure[kind+":"+key]
+	}
+	if a.Failures < max {
+		a.LockedUntil = time.Time{}
+	}
+	if a.Failures == 0 {
+		t.remove(a)
+		return
+	}
+	t.save(a)
+}
+
+// Record a successful login, which clears the failures for
+// the username and takes back the one counted against the
+// client's address
+func (t *loginThrottle) success(p *pendingLogin) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range p.usernames {
+		if a, ok := t.attempts[attemptsByUsername+":"+key]; ok {
+			t.remove(a)
+		}
+	}
+	t.unfail(p, attemptsByIP, p.ip, t.ipMaxFailures)
+}
+
+// Take back a login attempt that couldn't be checked, eg:
+// because the directory couldn't be reached. Attempts that
+// failed need nothing more, as they were counted when they
+// began.
+func (t *loginThrottle) abandon(p *pendingLogin) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range p.usernames {
+		t.unfail(p, attemptsByUsername, key, t.maxFailures)
+	}
+	t.unfail(p, attemptsByIP, p.ip, t.ipMaxFailures)
+}
+
+// save a set of attempts if persistence is turned on. The
+// mutex must be held.
+func (t *loginThrottle) save(a *loginAttempts) {
+	if !t.persist {
+		return
+	}
+	if err := store.SaveLoginAttempts(a); err != nil {
+		log.Errorf("Could not save login attempts for %s %s: %s", a.Kind, a.Key, err)
+	}
+}
+
+// forget a set of attempts. The mutex must be held.
+func (t *loginThrottle) remove(a *loginAttempts) {
+	delete(t.attempts, a.Kind+":"+a.Key)
+	if !t.persist {
+		return
+	}
+	if err := store.RemoveLoginAttempts(a.Kind, a.Key); err != nil {
+		log.Errorf("Could not clear login attempts for %s %s: %s", a.Kind, a.Key, err)
+	}
+}
+
+// forget about attempts that are old enough not to matter,
+// at most once a minute. The mutex must be held.
+func (t *loginThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for _, a := range t.attempts {
+		if now.After(a.LockedUntil) && now.Sub(a.LastFailure) > t.lockout {
+			t.remove(a)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock for a test, which only moves when it's told to
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// Use the ACME and OTHER directories for a test
+func useThrottleDirectories(tb testing.TB) {
+	previous := authOptions
+	authOptions = &AuthorizationOptions{directories: []*directory{
+		{name: "acme", realm: "ACME", upnSuffixes: []string{"acme.com"}},
+		{name: "other", realm: "OTHER", upnSuffixes: []string{"other.org"}},
+	}}
+	tb.Cleanup(func() { authOptions = previous })
+}
+
+// A throttle with the default settings and a test clock
+func newTestThrottle() (*loginThrottle, *testClock) {
+	clock := &testClock{t: time.Now()}
+	t := newLoginThrottle(&Config{})
+	t.now = clock.now
+	return t, clock
+}
+
+func TestThrottleKeys(t *testing.T) {
+	useThrottleDirectories(t)
+	tests := []struct {
+		username string
+		want     []string
+	}{
+		{"ACME\\Alice", []string{"acme\\alice"}},
+		{"acme\\alice", []string{"acme\\alice"}},
+		{"Alice@ACME.com", []string{"acme\\alice"}},
+		{"OTHER\\alice", []string{"other\\alice"}},
+		{"alice@other.org", []string{"other\\alice"}},
+		{"ALICE", []string{"acme\\alice", "other\\alice"}},
+		{"NOPE\\Alice", []string{"nope\\alice"}},
+	}
+	for _, tt := range tests {
+		if got := throttleKeys(tt.username); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("throttleKeys(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	useThrottleDirectories(t)
+	throttle, clock := newTestThrottle()
+	// each failure doubles the wait, up to the lockout
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if _, wait := throttle.begin("ACME\\alice", "10.0.0.1"); wait != 0 {
+			t.Fatalf("attempt %d waits %s, want none", i+1, wait)
+		}
+		if _, wait := throttle.begin("ACME\\alice", "10.0.0.2"); wait != want {
+			t.Fatalf("after %d failures, wait %s, want %s", i+1, wait, want)
+		}
+		clock.advance(want)
+	}
+
+	// the fifth failure locks the user out
+	if _, wait := throttle.begin("alice@acme.com", "10.0.0.1"); wait != 0 {
+		t.Fatalf("attempt 5 waits %s, want none", wait)
+	}
+	clock.advance(time.Minute)
+	if _, wait := throttle.begin("ACME\\alice", "10.0.0.3"); wait != defaultLockoutMinutes*time.Minute-time.Minute {
+		t.Errorf("locked out for %s, want %s", wait, defaultLockoutMinutes*time.Minute-time.Minute)
+	}
+	if _, wait := throttle.begin("OTHER\\alice", "10.0.0.3"); wait != 0 {
+		t.Errorf("OTHER\\alice waits %s, when ACME\\alice is locked out", wait)
+	}
+
+	// and the count starts again when the lockout runs out
+	clock.advance(defaultLockoutMinutes * time.Minute)
+	if _, wait := throttle.begin("ACME\\alice", "10.0.0.4"); wait != 0 {
+		t.Fatalf("after the lockout, wait %s, want none", wait)
+	}
+	if _, wait := throttle.begin("ACME\\alice", "10.0.0.5"); wait != time.Second {
+		t.Errorf("after the lockout and a failure, wait %s, want %s", wait, time.Second)
+	}
+}
+
+func TestThrottleMaxDelay(t *testing.T) {
+	useThrottleDirectories(t)
+	throttle, clock := newTestThrottle()
+	throttle.maxFailures = 100
+	throttle.ipMaxFailures = 100
+	for i := 0; i < 10; i++ {
+		throttle.begin("alice@acme.com", "10.0.0.1")
+		clock.advance(throttle.maxDelay)
+	}
+	clock.advance(-throttle.maxDelay)
+	if _, wait := throttle.begin("alice@acme.com", "10.0.0.1"); wait != throttle.maxDelay {
+		t.Errorf("after 10 failures, wait %s, want the most, %s", wait, throttle.maxDelay)
+	}
+}
+
+func TestThrottleBareUsernames(t *testing.T) {
+	useThrottleDirectories(t)
+	throttle, clock := newTestThrottle()
+	for i := 0; i < defaultMaxFailures; i++ {
+		if _, wait := throttle.begin("alice", "10.0.0.1"); wait != 0 {
+			t.Fatalf("attempt %d waits %s, want none", i+1, wait)
+		}
+		clock.advance(time.Minute)
+	}
+	// guesses at a bare name count against both alices
+	for _, username := range []string{"ACME\\alice", "OTHER\\alice", "alice"} {
+		if _, wait := throttle.begin(username, "10.0.0.2"); wait == 0 {
+			t.Errorf("%s isn't locked out after guesses at alice", username)
+		}
+	}
+	if _, wait := throttle.begin("ACME\\bob", "10.0.0.2"); wait != 0 {
+		t.Errorf("ACME\\bob waits %s, want none", wait)
+	}
+}
+
+func TestThrottleIPLimit(t *testing.T) {
+	useThrottleDirectories(t)
+	throttle, clock := newTestThrottle()
+	throttle.ipMaxFailures = 3
+	for _, username := range []string{"ACME\\amy", "ACME\\bob", "ACME\\cat"} {
+		if _, wait := throttle.begin(username, "10.0.0.1"); wait != 0 {
+			t.Fatalf("%s waits %s, want none", username, wait)
+		}
+		clock.advance(time.Minute)
+	}
+	if _, wait := throttle.begin("ACME\\dan", "10.0.0.1"); wait == 0 {
+		t.Errorf("the address isn't locked out after %d failures", throttle.ipMaxFailures)
+	}
+	if _, wait := throttle.begin("ACME\\dan", "10.0.0.2"); wait != 0 {
+		t.Errorf("another address waits %s, want none", wait)
+	}
+}
+
+func TestThrottleSettle(t *testing.T) {
+	useThrottleDirectories(t)
+	tests := []struct {
+		name string
+		// how the second attempt goes
+		settle func(*loginThrottle, *pendingLogin)
+		// the failures left for the username and the address
+		username int
+		ip       int
+	}{
+		{"failure", func(*loginThrottle, *pendingLogin) {}, 2, 2},
+		{"success", (*loginThrottle).success, 0, 1},
+		{"abandon", (*loginThrottle).abandon, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle, clock := newTestThrottle()
+			throttle.begin("ACME\\alice", "10.0.0.1")
+			clock.advance(time.Minute)
+			p, wait := throttle.begin("ACME\\alice", "10.0.0.1")
+			if wait != 0 {
+				t.Fatalf("the second attempt waits %s", wait)
+			}
+			tt.settle(throttle, p)
+
+			failures := func(key string) int {
+				if a := throttle.attempts[key]; a != nil {
+					return a.Failures
+				}
+				return 0
+			}
+			if got := failures(attemptsByUsername + ":acme\\alice"); got != tt.username {
+				t.Errorf("%d failures for the username, want %d", got, tt.username)
+			}
+			if got := failures(attemptsByIP + ":10.0.0.1"); got != tt.ip {
+				t.Errorf("%d failures for the address, want %d", got, tt.ip)
+			}
+			if tt.name == "abandon" {
+				// the backoff is back to the first failure's
+				if _, wait := throttle.begin("ACME\\alice", "10.0.0.2"); wait != 0 {
+					t.Errorf("after abandoning, wait %s, want none", wait)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleParallelAttempts(t *testing.T) {
+	useThrottleDirectories(t)
+	throttle, _ := newTestThrottle()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, wait := throttle.begin("ACME\\alice", "10.0.0.1"); wait == 0 {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 {
+		t.Errorf("%d guesses sent at once were let through, want 1", allowed)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes that can be granted to an API token
+const (
+	// read the board, a single person, and the status codes
+	ScopePeopleRead = "people:read"
+	// change the status and remarks of the token's owner
+	ScopeStatusWriteSelf = "status:write:self"
+	// change the status and remarks of anyone on the board
+	ScopeStatusWrite = "status:write"
+)
+
+var validScopes = map[string]bool{
+	ScopePeopleRead:      true,
+	ScopeStatusWriteSelf: true,
+	ScopeStatusWrite:     true,
+}
+
+// prefix for generated tokens, to make them easy
+// to recognize in scripts and secret scanners
+const tokenPrefix = "iob_"
+
+// A long-lived API token. The token itself is only
+// returned once, when it is created.
+type APIToken struct {
+	ID         int
+	Name       string
+	Scopes     []string
+	CreateTime time.Time
+	Expires    *time.Time
+	LastUsed   *time.Time
+	Token      string `json:",omitempty"`
+}
+
+// A request to create a new API token
+type tokenRequest struct {
+	Name   string
+	Scopes []string
+	// Number of days until the token expires. Zero means never.
+	ExpiresDays int
+}
+
+// generate a new random token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(b), nil
+}
+
+// hash a token for storage and lookup
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// get the token from a bearer Authorization header,
+// or an empty string if there isn't one
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// List, create and revoke the API tokens of the current user.
+// Tokens can only be managed from a browser session, not
+// with another token.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS, HEAD")
+	username := usernameFromContext(r.Context())
+
+	if scopesFromContext(r.Context()) != nil {
+		http.Error(w, "tokens cannot be managed with a token", http.StatusForbidden)
+		return
+	}
+
+	idPart := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+
+	switch r.Method {
+	case "OPTIONS":
+		return
+	case "GET":
+		tokens, err := store.GetTokens(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = json.NewEncoder(w).Encode(tokens); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "POST":
+		req := new(tokenRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			http.Error(w, "at least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !validScopes[scope] {
+				http.Error(w, fmt.Sprintf("unknown scope %s", scope), http.StatusBadRequest)
+				return
+			}
+		}
+		var expires NullTime
+		if req.ExpiresDays > 0 {
+			expires = NullTime{Time: time.Now().UTC().AddDate(0, 0, req.ExpiresDays), Valid: true}
+		}
+		token, err := newToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		created, err := store.CreateToken(username, req.Name, hashToken(token), req.Scopes, expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Created API token %d for %s", created.ID, username)
+		created.Token = token
+		w.WriteHeader(http.StatusCreated)
+		if err = json.NewEncoder(w).Encode(created); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "DELETE":
+		id, err := strconv.Atoi(idPart)
+		if err != nil {
+			http.Error(w, "a token id is required", http.StatusBadRequest)
+			return
+		}
+		if err = store.RemoveToken(username, id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		log.Infof("Revoked API token %d for %s", id, username)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
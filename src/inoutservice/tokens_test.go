@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The API routes tokens can reach, or are kept from, as
+// they're set up in main
+func tokenTestServer(t *testing.T) (*sqlStore, http.Handler) {
+	t.Helper()
+	s := useTestStore(t)
+	previous := board
+	board = newBoardCache(s)
+	t.Cleanup(func() { board = previous })
+
+	for username, name := range map[string]string{"amy": "Amy", "bob": "Bob"} {
+		if _, err := s.AddPerson(username, name, "Sales", "", "", "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/user/", AuthorizationMiddleware(AddHeaders(http.StripPrefix("/api/", http.HandlerFunc(handler)))))
+	mux.Handle("/api/statuscodes", AuthorizationMiddleware(AddHeaders(http.HandlerFunc(statusHandler))))
+	tokens := AuthorizationMiddleware(AddHeaders(http.HandlerFunc(tokensHandler)))
+	mux.Handle("/api/tokens", tokens)
+	mux.Handle("/api/tokens/", tokens)
+	mux.Handle("/api/admin/export", AuthorizationMiddleware(AddHeaders(RequireRole(RoleAdmin, http.HandlerFunc(exportHandler)))))
+	return s, mux
+}
+
+// Give amy a token with some scopes, returning the token
+func addTestToken(t *testing.T, s *sqlStore, scopes []string, expires NullTime) string {
+	t.Helper()
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CreateToken("amy", "test", hashToken(token), scopes, expires); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Give amy a browser session, returning its ID
+func addTestSession(t *testing.T, s *sqlStore, roles []string) string {
+	t.Helper()
+	amy, err := s.GetPerson("amy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateSession("session-"+strings.Join(roles, "-"), amy.ID, roles); err != nil {
+		t.Fatal(err)
+	}
+	return "session-" + strings.Join(roles, "-")
+}
+
+func TestTokenAuthorization(t *testing.T) {
+	expired := NullTime{Time: time.Now().UTC().Add(-time.Hour), Valid: true}
+	later := NullTime{Time: time.Now().UTC().Add(time.Hour), Valid: true}
+	setStatus := func(username string) string {
+		return `{"Username": "` + username + `", "Status": {"Code": 2}, "Remarks": "away"}`
+	}
+	tests := []struct {
+		name    string
+		scopes  []string
+		expires NullTime
+		// use a token that was never issued
+		unknown bool
+		// remove amy from the board first
+		removed bool
+		method  string
+		path    string
+		body    string
+		want    int
+	}{
+		{"read someone", []string{ScopePeopleRead}, NullTime{}, false, false, "GET", "/api/user/bob", "", http.StatusOK},
+		{"read the status codes", []string{ScopePeopleRead}, NullTime{}, false, false, "GET", "/api/statuscodes", "", http.StatusOK},
+		{"read before it expires", []string{ScopePeopleRead}, later, false, false, "GET", "/api/user/bob", "", http.StatusOK},
+		{"read without the scope", []string{ScopeStatusWriteSelf}, NullTime{}, false, false, "GET", "/api/user/bob", "", http.StatusForbidden},
+		{"an expired token", []string{ScopePeopleRead}, expired, false, false, "GET", "/api/user/bob", "", http.StatusUnauthorized},
+		{"a token that wasn't issued", []string{ScopePeopleRead}, NullTime{}, true, false, "GET", "/api/user/bob", "", http.StatusUnauthorized},
+		{"a token whose owner was removed", []string{ScopePeopleRead}, NullTime{}, false, true, "GET", "/api/user/bob", "", http.StatusUnauthorized},
+		{"set your own status", []string{ScopeStatusWriteSelf}, NullTime{}, false, false, "PUT", "/api/user/", setStatus("amy"), http.StatusOK},
+		{"set someone else's status with the self scope", []string{ScopeStatusWriteSelf}, NullTime{}, false, false, "PUT", "/api/user/", setStatus("bob"), http.StatusForbidden},
+		{"set someone else's status", []string{ScopeStatusWrite}, NullTime{}, false, false, "PUT", "/api/user/", setStatus("bob"), http.StatusOK},
+		{"set a status with only the read scope", []string{ScopePeopleRead}, NullTime{}, false, false, "PUT", "/api/user/", setStatus("amy"), http.StatusForbidden},
+		{"list tokens", []string{ScopePeopleRead, ScopeStatusWrite}, NullTime{}, false, false, "GET", "/api/tokens", "", http.StatusForbidden},
+		{"create a token", []string{ScopePeopleRead, ScopeStatusWrite}, NullTime{}, false, false, "POST", "/api/tokens/", `{"Scopes": ["people:read"]}`, http.StatusForbidden},
+		{"revoke a token", []string{ScopePeopleRead, ScopeStatusWrite}, NullTime{}, false, false, "DELETE", "/api/tokens/1", "", http.StatusForbidden},
+		{"an admin route", []string{ScopePeopleRead, ScopeStatusWrite}, NullTime{}, false, false, "GET", "/api/admin/export", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, server := tokenTestServer(t)
+			token := addTestToken(t, s, tt.scopes, tt.expires)
+			if tt.unknown {
+				token += "0"
+			}
+			if tt.removed {
+				if err := s.RemovePerson(&Person{Username: "amy"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenManagement(t *testing.T) {
+	s, server := tokenTestServer(t)
+	session := addTestSession(t, s, nil)
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: "session", Value: session})
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("POST", "/api/tokens", `{"Name": "script", "Scopes": ["people:read"], "ExpiresDays": 30}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a token = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var created APIToken
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, tokenPrefix) || created.Expires == nil {
+		t.Fatalf("created %+v, want a token that expires", created)
+	}
+
+	// only the hash is kept
+	var stored string
+	if err := s.queryRow("SELECT token_hash FROM api_tokens WHERE id = ?", created.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != hashToken(created.Token) {
+		t.Errorf("stored %q, want the SHA-256 hash of the token %q", stored, hashToken(created.Token))
+	}
+	var matches int
+	if err := s.queryRow("SELECT count(*) FROM api_tokens WHERE token_hash = ? OR name = ? OR scopes = ?", created.Token, created.Token, created.Token).Scan(&matches); err != nil {
+		t.Fatal(err)
+	}
+	if matches != 0 {
+		t.Errorf("the token itself is in the database")
+	}
+
+	// it isn't shown again
+	w = request("GET", "/api/tokens/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing tokens = %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), created.Token) {
+		t.Errorf("the token is in the list of tokens: %s", w.Body)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"Scopes": []}`, http.StatusBadRequest},
+		{`{"Scopes": ["admin"]}`, http.StatusBadRequest},
+		{`{"Scopes": `, http.StatusBadRequest},
+	} {
+		if w = request("POST", "/api/tokens", tt.body); w.Code != tt.want {
+			t.Errorf("creating a token with %s = %d, want %d", tt.body, w.Code, tt.want)
+		}
+	}
+
+	// the token works until it's revoked
+	read := func() int {
+		r := httptest.NewRequest("GET", "/api/user/bob", nil)
+		r.Header.Set("Authorization", "Bearer "+created.Token)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := read(); code != http.StatusOK {
+		t.Fatalf("reading with the new token = %d", code)
+	}
+	if w = request("DELETE", "/api/tokens/"+strconv.Itoa(created.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking the token = %d %s", w.Code, w.Body)
+	}
+	if code := read(); code != http.StatusUnauthorized {
+		t.Errorf("reading with a revoked token = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		scope  string
+		wanted bool
+	}{
+		{"a session", context.Background(), ScopeStatusWrite, true},
+		{"a token with the scope", newContextWithScopes(context.Background(), []string{ScopePeopleRead, ScopeStatusWrite}), ScopeStatusWrite, true},
+		{"a token without the scope", newContextWithScopes(context.Background(), []string{ScopeStatusWriteSelf}), ScopeStatusWrite, false},
+		{"a token with no scopes", newContextWithScopes(context.Background(), nil), ScopePeopleRead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasScope(tt.ctx, tt.scope); got != tt.wanted {
+				t.Errorf("hasScope(%q) = %v, want %v", tt.scope, got, tt.wanted)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"Bearer iob_abc", "iob_abc"},
+		{"bearer  iob_abc ", "iob_abc"},
+		{"Basic YWxhZGRpbjpvcGVuc2VzYW1l", ""},
+		{"Bearer ", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := bearerToken(r); got != tt.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}